@@ -7,8 +7,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/rbuysse/image-uploader/grombley"
 )
 
 const usage = `Usage:
@@ -18,15 +20,11 @@ const usage = `Usage:
   -u, --upload-path    Path to store uploaded images (default: ./uploads/)`
 
 // Default config
-func defaultConfig() Config {
-	return Config{
-		Bind:       "0.0.0.0:3000",
-		ServePath:  "/i/",
-		UploadPath: "./uploads/",
-	}
+func defaultConfig() grombley.Config {
+	return grombley.DefaultConfig()
 }
 
-func GenerateConfig() Config {
+func GenerateConfig() grombley.Config {
 	var bindOpt string
 	var configFile string
 	var configFileSet bool
@@ -62,7 +60,7 @@ func GenerateConfig() Config {
 	}
 
 	// Check if the config file exists
-	var config Config
+	var config grombley.Config
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		if configFileSet {
 			log.Fatalf("Config file %v specified but not found.\n", configFile)
@@ -111,15 +109,49 @@ func GenerateConfig() Config {
 	return config
 }
 
-func loadConfig(configFile string) Config {
+func loadConfig(configFile string) grombley.Config {
 	config := defaultConfig()
 
 	// Temporary struct to decode TOML file
 	var tempConfig struct {
-		Bind       string `toml:"bind"`
-		Debug      bool   `toml:"debug"`
-		ServePath  string `toml:"serve_path"`
-		UploadPath string `toml:"upload_path"`
+		Bind       string        `toml:"bind"`
+		Debug      bool          `toml:"debug"`
+		ServePath  string        `toml:"serve_path"`
+		UploadPath string        `toml:"upload_path"`
+		DefaultTTL time.Duration `toml:"default_ttl"`
+		MaxTTL     time.Duration `toml:"max_ttl"`
+
+		MaxUploadBytes int64 `toml:"max_upload_bytes"`
+		MaxPixels      int64 `toml:"max_pixels"`
+
+		FetchAllow          []string      `toml:"fetch_allow"`
+		FetchConnectTimeout time.Duration `toml:"fetch_connect_timeout"`
+		FetchTimeout        time.Duration `toml:"fetch_timeout"`
+		FetchMaxBytes       int64         `toml:"fetch_max_bytes"`
+		FetchMaxRedirects   *int          `toml:"fetch_max_redirects"`
+
+		Storage string            `toml:"storage"`
+		S3      grombley.S3Config `toml:"s3"`
+
+		ThumbCachePath  string   `toml:"thumb_cache_path"`
+		ThumbCacheBytes int64    `toml:"thumb_cache_bytes"`
+		ThumbSizes      []string `toml:"thumb_sizes"`
+
+		NormalizeOrientation bool `toml:"normalize_orientation"`
+
+		APITokens []grombley.APIToken `toml:"api_tokens"`
+		TokenFile string              `toml:"token_file"`
+
+		OIDC grombley.OIDCConfig `toml:"oidc"`
+
+		UploadRate     grombley.RateLimitConfig `toml:"upload_rate"`
+		ThumbRate      grombley.RateLimitConfig `toml:"thumb_rate"`
+		DailyUploads   int64                    `toml:"daily_uploads"`
+		DailyBytes     int64                    `toml:"daily_bytes"`
+		TrustedProxies []string                 `toml:"trusted_proxies"`
+		PublicURL      string                   `toml:"public_url"`
+
+		TLS grombley.TLSConfig `toml:"tls"`
 	}
 
 	if _, err := toml.DecodeFile(configFile, &tempConfig); err != nil {
@@ -139,6 +171,82 @@ func loadConfig(configFile string) Config {
 	if tempConfig.Debug {
 		config.Debug = true
 	}
+	if tempConfig.DefaultTTL != 0 {
+		config.DefaultTTL = tempConfig.DefaultTTL
+	}
+	if tempConfig.MaxTTL != 0 {
+		config.MaxTTL = tempConfig.MaxTTL
+	}
+	if tempConfig.MaxUploadBytes != 0 {
+		config.MaxUploadBytes = tempConfig.MaxUploadBytes
+	}
+	if tempConfig.MaxPixels != 0 {
+		config.MaxPixels = tempConfig.MaxPixels
+	}
+	if len(tempConfig.FetchAllow) > 0 {
+		config.FetchAllow = tempConfig.FetchAllow
+	}
+	if tempConfig.FetchConnectTimeout != 0 {
+		config.FetchConnectTimeout = tempConfig.FetchConnectTimeout
+	}
+	if tempConfig.FetchTimeout != 0 {
+		config.FetchTimeout = tempConfig.FetchTimeout
+	}
+	if tempConfig.FetchMaxBytes != 0 {
+		config.FetchMaxBytes = tempConfig.FetchMaxBytes
+	}
+	if tempConfig.FetchMaxRedirects != nil {
+		config.FetchMaxRedirects = tempConfig.FetchMaxRedirects
+	}
+	if tempConfig.Storage != "" {
+		config.Storage = tempConfig.Storage
+	}
+	if tempConfig.S3 != (grombley.S3Config{}) {
+		config.S3 = tempConfig.S3
+	}
+	if tempConfig.ThumbCachePath != "" {
+		config.ThumbCachePath = tempConfig.ThumbCachePath
+	}
+	if tempConfig.ThumbCacheBytes != 0 {
+		config.ThumbCacheBytes = tempConfig.ThumbCacheBytes
+	}
+	if tempConfig.NormalizeOrientation {
+		config.NormalizeOrientation = true
+	}
+	if len(tempConfig.ThumbSizes) > 0 {
+		config.ThumbSizes = tempConfig.ThumbSizes
+	}
+	if len(tempConfig.APITokens) > 0 {
+		config.APITokens = tempConfig.APITokens
+	}
+	if tempConfig.TokenFile != "" {
+		config.TokenFile = tempConfig.TokenFile
+	}
+	if tempConfig.OIDC.Issuer != "" {
+		config.OIDC = tempConfig.OIDC
+	}
+	if tempConfig.UploadRate != (grombley.RateLimitConfig{}) {
+		config.UploadRate = tempConfig.UploadRate
+	}
+	if tempConfig.ThumbRate != (grombley.RateLimitConfig{}) {
+		config.ThumbRate = tempConfig.ThumbRate
+	}
+	if tempConfig.DailyUploads != 0 {
+		config.DailyUploads = tempConfig.DailyUploads
+	}
+	if tempConfig.DailyBytes != 0 {
+		config.DailyBytes = tempConfig.DailyBytes
+	}
+	if len(tempConfig.TrustedProxies) > 0 {
+		config.TrustedProxies = tempConfig.TrustedProxies
+	}
+	if tempConfig.PublicURL != "" {
+		config.PublicURL = tempConfig.PublicURL
+	}
+	if tempConfig.TLS.CertFile != "" || tempConfig.TLS.KeyFile != "" ||
+		len(tempConfig.TLS.ACME.Domains) > 0 || tempConfig.TLS.RedirectBind != "" {
+		config.TLS = tempConfig.TLS
+	}
 
 	return config
 }
@@ -0,0 +1,189 @@
+package grombley
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Uploading can be limited to holders of API tokens, sent as
+// "Authorization: Bearer <token>", and to users signed in with OIDC. With
+// neither configured anyone may upload, as before. Serving images never
+// needs a token.
+
+// Scopes an API token can be given
+const (
+	scopeUpload = "upload"
+	scopeDelete = "delete"
+	// scopeAdmin allows everything
+	scopeAdmin = "admin"
+)
+
+// APIToken is a named bearer token. Only its SHA-256 is kept, as hex, so the
+// config doesn't hold anything that can be used to upload.
+type APIToken struct {
+	Name   string   `toml:"name"`
+	Hash   string   `toml:"hash"`
+	Scopes []string `toml:"scopes"`
+
+	// DailyUploads and DailyBytes override the server-wide quotas
+	DailyUploads int64 `toml:"daily_uploads"`
+	DailyBytes   int64 `toml:"daily_bytes"`
+}
+
+// allows reports whether the token carries scope
+func (t APIToken) allows(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, scopeAdmin)
+}
+
+// loadTokenFile reads the [[api_tokens]] tables from a TOML file
+func loadTokenFile(path string) ([]APIToken, error) {
+	var file struct {
+		APITokens []APIToken `toml:"api_tokens"`
+	}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		return nil, fmt.Errorf("error reading token file: %w", err)
+	}
+	return file.APITokens, nil
+}
+
+// parseAPITokens checks the configured tokens and indexes them by hash
+func parseAPITokens(tokens []APIToken) (map[string]APIToken, error) {
+	byHash := make(map[string]APIToken, len(tokens))
+	names := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		if token.Name == "" {
+			return nil, fmt.Errorf("api token with no name")
+		}
+		if names[token.Name] {
+			return nil, fmt.Errorf("api token %q is defined twice", token.Name)
+		}
+		names[token.Name] = true
+
+		token.Hash = strings.ToLower(token.Hash)
+		if b, err := hex.DecodeString(token.Hash); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("api token %q: hash must be a hex SHA-256", token.Name)
+		}
+		if _, ok := byHash[token.Hash]; ok {
+			return nil, fmt.Errorf("api token %q has the same hash as another", token.Name)
+		}
+		if token.DailyUploads < 0 || token.DailyBytes < 0 {
+			return nil, fmt.Errorf("api token %q: daily quotas must not be negative", token.Name)
+		}
+		if len(token.Scopes) == 0 {
+			return nil, fmt.Errorf("api token %q has no scopes", token.Name)
+		}
+		for _, scope := range token.Scopes {
+			switch scope {
+			case scopeUpload, scopeDelete, scopeAdmin:
+			default:
+				return nil, fmt.Errorf("api token %q: unknown scope %q", token.Name, scope)
+			}
+		}
+		byHash[token.Hash] = token
+	}
+	return byHash, nil
+}
+
+type uploaderContextKey struct{}
+
+// requestUploader names the API token or signed-in user a request was
+// authorized as
+func requestUploader(r *http.Request) (string, bool) {
+	name, ok := r.Context().Value(uploaderContextKey{}).(string)
+	return name, ok
+}
+
+// bearerToken looks up the token in a request's Authorization header. present
+// is false if the request didn't send one at all.
+func (s *Server) bearerToken(r *http.Request) (token APIToken, present bool, ok bool) {
+	scheme, credentials, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return APIToken{}, false, false
+	}
+	credentials = strings.TrimSpace(credentials)
+	if credentials == "" {
+		return APIToken{}, false, false
+	}
+	token, ok = s.apiTokens[hashToken(credentials)]
+	return token, true, ok
+}
+
+// quotaLimits returns an uploader's daily upload and byte quotas
+func (s *Server) quotaLimits(uploader string) (int64, int64) {
+	uploads, bytes := s.config.DailyUploads, s.config.DailyBytes
+	for _, token := range s.apiTokens {
+		if token.Name != uploader {
+			continue
+		}
+		if token.DailyUploads != 0 {
+			uploads = token.DailyUploads
+		}
+		if token.DailyBytes != 0 {
+			bytes = token.DailyBytes
+		}
+	}
+	return uploads, bytes
+}
+
+// tokenAllows reports whether a request carries a valid token with scope
+func (s *Server) tokenAllows(r *http.Request, scope string) bool {
+	token, _, ok := s.bearerToken(r)
+	return ok && token.allows(scope)
+}
+
+// requireScope lets requests through to next only with a token carrying
+// scope, or a session if scope is upload, when either is configured. Who
+// it was goes in the request context so uploads can be recorded against it.
+func (s *Server) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.apiTokens) == 0 && s.oidc == nil {
+			next(w, r)
+			return
+		}
+		// Preflights can't carry credentials, so they go through to the
+		// handler: the upload handlers refuse OPTIONS, and tus answers it
+		// without touching any upload. Only tus honors the method override.
+		isTus := r.URL.Path == strings.TrimSuffix(tusPath, "/") || strings.HasPrefix(r.URL.Path, tusPath)
+		if r.Method == http.MethodOptions || (isTus && r.Header.Get("X-HTTP-Method-Override") == http.MethodOptions) {
+			next(w, r)
+			return
+		}
+
+		token, present, ok := s.bearerToken(r)
+		if !present && scope == scopeUpload {
+			if sess, ok := s.currentSession(r); ok {
+				next(w, r.WithContext(context.WithValue(r.Context(), uploaderContextKey{}, sess.name())))
+				return
+			}
+		}
+		switch {
+		case !present:
+			message := "An API token is required"
+			if s.oidc != nil {
+				message = "Sign in or send an API token"
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="grombley"`)
+			writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, message)
+			return
+		case !ok:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="grombley", error="invalid_token"`)
+			writeError(w, r, http.StatusUnauthorized, errCodeInvalidToken, "Invalid API token")
+			return
+		case !token.allows(scope):
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="grombley", error="insufficient_scope", scope=%q`, scope))
+			writeError(w, r, http.StatusForbidden, errCodeInsufficientScope, fmt.Sprintf("API token lacks the %s scope", scope))
+			return
+		}
+
+		if s.config.Debug {
+			fmt.Printf("Request %s %s with API token %s\n", r.Method, r.URL.Path, token.Name)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), uploaderContextKey{}, token.Name)))
+	}
+}
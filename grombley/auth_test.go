@@ -0,0 +1,266 @@
+package grombley
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testTokens are API tokens for tests, keyed by the token itself
+var testTokens = map[string]APIToken{
+	"uploader-secret": {Name: "uploader", Scopes: []string{scopeUpload}},
+	"deleter-secret":  {Name: "deleter", Scopes: []string{scopeDelete}},
+	"admin-secret":    {Name: "admin", Scopes: []string{scopeAdmin}},
+}
+
+func newTokenServer(t *testing.T) *Server {
+	t.Helper()
+	var config Config
+	for secret, token := range testTokens {
+		token.Hash = hashToken(secret)
+		config.APITokens = append(config.APITokens, token)
+	}
+	return newTestServerWithConfig(t, config)
+}
+
+func TestParseAPITokens(t *testing.T) {
+	hash := hashToken("secret")
+	testCases := []struct {
+		name   string
+		tokens []APIToken
+		err    string
+	}{
+		{"valid", []APIToken{{Name: "a", Hash: strings.ToUpper(hash), Scopes: []string{"upload"}}}, ""},
+		{"no name", []APIToken{{Hash: hash, Scopes: []string{"upload"}}}, "no name"},
+		{"bad hash", []APIToken{{Name: "a", Hash: "secret", Scopes: []string{"upload"}}}, "hex SHA-256"},
+		{"no scopes", []APIToken{{Name: "a", Hash: hash}}, "no scopes"},
+		{"unknown scope", []APIToken{{Name: "a", Hash: hash, Scopes: []string{"root"}}}, "unknown scope"},
+		{"duplicate name", []APIToken{
+			{Name: "a", Hash: hash, Scopes: []string{"upload"}},
+			{Name: "a", Hash: hashToken("other"), Scopes: []string{"upload"}},
+		}, "defined twice"},
+		{"duplicate hash", []APIToken{
+			{Name: "a", Hash: hash, Scopes: []string{"upload"}},
+			{Name: "b", Hash: hash, Scopes: []string{"delete"}},
+		}, "same hash"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			byHash, err := parseAPITokens(tc.tokens)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if _, ok := byHash[hash]; !ok {
+					t.Error("expected the token to be indexed by its lowercase hash")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestUploadRequiresToken(t *testing.T) {
+	s := newTokenServer(t)
+	data := testPNG(t, 70)
+
+	upload := func(token string) *httptest.ResponseRecorder {
+		req := uploadRequest(t, data)
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := upload("")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", rr.Code)
+	}
+	if !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("expected a Bearer challenge, got %q", rr.Header().Get("WWW-Authenticate"))
+	}
+
+	rr = upload("wrong-secret")
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), errCodeInvalidToken) {
+		t.Errorf("expected 401 invalid_token for a bad token, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = upload("deleter-secret")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), errCodeInsufficientScope) {
+		t.Errorf("expected 403 insufficient_scope for a delete token, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = upload("uploader-secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the upload to succeed, got %d %s", rr.Code, rr.Body.String())
+	}
+	var result uploadResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode upload response: %v", err)
+	}
+	name := imageNameFromURL(result.URL)
+	if rec, _ := s.images.LookupName(name); rec.Uploader != "uploader" {
+		t.Errorf("expected the upload to be recorded against uploader, got %q", rec.Uploader)
+	}
+
+	// Serving stays public
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/i/"+name, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the image to be served without a token, got %d", rr.Code)
+	}
+
+	// Other upload endpoints are covered too
+	for _, path := range []string{"/url", "/upload/x.png", tusPath} {
+		rr = httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader("{}")))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("POST %s: expected 401 without a token, got %d", path, rr.Code)
+		}
+	}
+
+	// tus discovery doesn't need one
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("OPTIONS", tusPath, nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected tus OPTIONS to work without a token, got %d", rr.Code)
+	}
+}
+
+func TestDeleteWithAPIToken(t *testing.T) {
+	s := newTokenServer(t)
+
+	req := uploadRequest(t, testPNG(t, 80))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	var result uploadResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode upload response: %v", err)
+	}
+	name := imageNameFromURL(result.URL)
+
+	del := func(token string) int {
+		req := httptest.NewRequest("DELETE", "/i/"+name, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := del("uploader-secret"); code != http.StatusForbidden {
+		t.Errorf("expected an upload token not to delete, got %d", code)
+	}
+	if code := del("deleter-secret"); code != http.StatusNoContent {
+		t.Fatalf("expected a delete token to delete without the delete token, got %d", code)
+	}
+	if _, ok := s.images.LookupName(name); ok {
+		t.Error("expected the image to be gone")
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.toml")
+	content := `
+[[api_tokens]]
+name = "from-file"
+hash = "` + hashToken("file-secret") + `"
+scopes = ["upload"]
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServerWithConfig(t, Config{TokenFile: path})
+	req := uploadRequest(t, testPNG(t, 90))
+	req.Header.Set("Authorization", "Bearer file-secret")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected a token from the file to upload, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if _, err := New(Config{UploadPath: t.TempDir(), TokenFile: filepath.Join(t.TempDir(), "missing.toml")}); err == nil {
+		t.Error("expected a missing token file to be an error")
+	}
+}
+
+func TestOptionsCantUpload(t *testing.T) {
+	s := newTokenServer(t)
+	png := testPNG(t, 72)
+
+	multipart := uploadRequest(t, png)
+	multipart.Method = "OPTIONS"
+	raw := httptest.NewRequest("OPTIONS", "/upload/x.png", strings.NewReader(string(png)))
+	urlReq := httptest.NewRequest("OPTIONS", "/url", strings.NewReader(`{"url": "http://example.com/a.png"}`))
+	urlReq.Header.Set("Content-Type", "application/json")
+
+	// The upload handlers refuse OPTIONS without needing a token
+	for _, req := range []*http.Request{multipart, raw, urlReq} {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("OPTIONS %s: expected 405, got %d", req.URL.Path, rr.Code)
+		}
+	}
+
+	// tus answers preflights, including a POST that asks to be treated as
+	// OPTIONS, and an OPTIONS that asks to be a POST is still a preflight
+	tusOptions := httptest.NewRequest("OPTIONS", tusPath, nil)
+	tusOptions.Header.Set("X-HTTP-Method-Override", "POST")
+	tusOptions.Header.Set("Tus-Resumable", tusVersion)
+	tusOptions.Header.Set("Upload-Length", "10")
+	tusOverride := httptest.NewRequest("POST", tusPath, nil)
+	tusOverride.Header.Set("X-HTTP-Method-Override", "OPTIONS")
+	tusOverride.Header.Set("Tus-Resumable", tusVersion)
+	tusOverride.Header.Set("Upload-Length", "10")
+	for _, req := range []*http.Request{tusOptions, tusOverride} {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Location") != "" {
+			t.Errorf("%s %s: expected a bare 204, got %d", req.Method, req.URL.Path, rr.Code)
+		}
+	}
+
+	// Elsewhere a POST that asks to be treated as OPTIONS still needs a token
+	for _, target := range []string{"/upload", "/upload/x.png", "/url"} {
+		override := uploadRequest(t, png)
+		override.URL.Path = target
+		override.RequestURI = target
+		override.Header.Set("X-HTTP-Method-Override", "OPTIONS")
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, override)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected an OPTIONS override without a token to get 401, got %d", target, rr.Code)
+		}
+	}
+
+	if n := s.images.Count(); n != 0 {
+		t.Errorf("expected nothing to be stored, have %d images", n)
+	}
+	if entries, _ := os.ReadDir(s.tus.dir); len(entries) != 0 {
+		t.Errorf("expected no tus uploads to be created, have %d", len(entries))
+	}
+
+	// Without tokens OPTIONS reaches the handlers, which refuse it
+	open := newTestServer(t)
+	multipart = uploadRequest(t, png)
+	multipart.Method = "OPTIONS"
+	rr := httptest.NewRecorder()
+	open.Handler().ServeHTTP(rr, multipart)
+	if rr.Code != http.StatusMethodNotAllowed || open.images.Count() != 0 {
+		t.Errorf("expected OPTIONS /upload to be refused, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,114 @@
+package grombley
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// batchUploadWorkers bounds how many files of one batch are processed at once
+const batchUploadWorkers = 4
+
+// batchResult is the outcome for one file of a batch upload. Either the
+// upload fields or Error and Code are set.
+type batchResult struct {
+	Filename string `json:"filename"`
+	*uploadResult
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// batchFiles returns the files of a multi-file upload, or nil for a regular
+// single-file one. Files may be sent as repeated "file" or "files" fields.
+func batchFiles(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	var files []*multipart.FileHeader
+	files = append(files, r.MultipartForm.File["file"]...)
+	files = append(files, r.MultipartForm.File["files"]...)
+	if len(files) < 2 && len(r.MultipartForm.File["files"]) == 0 {
+		return nil
+	}
+	return files
+}
+
+func (s *Server) batchUploadHandler(w http.ResponseWriter, r *http.Request, files []*multipart.FileHeader) {
+	ttl, err := s.requestTTL(r, r.FormValue("expires"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	results := make([]batchResult, len(files))
+	sem := make(chan struct{}, batchUploadWorkers)
+	var wg sync.WaitGroup
+
+	for i, fh := range files {
+		wg.Add(1)
+		go func(i int, fh *multipart.FileHeader) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = batchResult{Filename: fh.Filename}
+
+			file, err := fh.Open()
+			if err != nil {
+				results[i].Error = "Error retrieving the file"
+				results[i].Code = errCodeInvalidRequest
+				return
+			}
+			defer file.Close()
+
+			result, err := s.storeImage(r, file, uploadOptions{TTL: ttl})
+			if err != nil {
+				if s.config.Debug {
+					fmt.Printf("Batch upload of %s failed: %v\n", fh.Filename, err)
+				}
+				results[i].Error, results[i].Code = "Error processing file", errCodeInternal
+				var uerr *uploadError
+				if errors.As(err, &uerr) {
+					results[i].Error, results[i].Code = uerr.Message, uerr.Code
+				}
+				return
+			}
+			results[i].uploadResult = &result
+		}(i, fh)
+	}
+	wg.Wait()
+
+	respondWithBatch(w, r, results)
+}
+
+// respondWithBatch writes a JSON array of results, or one line per file in
+// plain text: the URL on success or "error: <message>" on failure
+func respondWithBatch(w http.ResponseWriter, r *http.Request, results []batchResult) error {
+	switch {
+	case wantsJSON(r):
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(results)
+		if err != nil {
+			http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
+			return err
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var b strings.Builder
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Fprintf(&b, "error: %s\n", result.Error)
+			} else {
+				fmt.Fprintf(&b, "%s\n", result.URL)
+			}
+		}
+		if _, err := w.Write([]byte(b.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
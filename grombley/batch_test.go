@@ -0,0 +1,126 @@
+package grombley
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// batchRequest builds a multipart request with each file in the given field
+func batchRequest(t *testing.T, field string, files [][]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, data := range files {
+		part, err := mw.CreateFormFile(field, fmt.Sprintf("shot%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestBatchUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	existing := uploadJSON(t, s, testPNG(t, 90))
+
+	files := [][]byte{
+		testPNG(t, 100),
+		[]byte("not an image"),
+		testPNG(t, 90),
+		testPNG(t, 110),
+		testPNG(t, 100),
+	}
+
+	req := batchRequest(t, "files", files)
+	req.Header.Set("Accept", "application/json")
+	rr := serve(s, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a partially failed batch, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Decoded flat; the embedded pointer in batchResult can't be unmarshalled into
+	var results []struct {
+		Filename    string `json:"filename"`
+		URL         string `json:"url"`
+		DeleteToken string `json:"delete_token"`
+		Duplicate   bool   `json:"duplicate"`
+		Error       string `json:"error"`
+		Code        string `json:"code"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode batch response: %v\n%s", err, rr.Body.String())
+	}
+	if len(results) != len(files) {
+		t.Fatalf("expected %d results, got %d", len(files), len(results))
+	}
+
+	for i, result := range results {
+		if want := fmt.Sprintf("shot%d.png", i); result.Filename != want {
+			t.Errorf("result %d: expected filename %s, got %s", i, want, result.Filename)
+		}
+	}
+
+	if results[1].Error != "Unsupported file type" || results[1].Code != errCodeUnsupportedType || results[1].URL != "" {
+		t.Errorf("expected unsupported type error for the second file, got %+v", results[1])
+	}
+	if results[2].URL != existing.URL || !results[2].Duplicate {
+		t.Errorf("expected third file to dedup to %s, got %+v", existing.URL, results[2])
+	}
+	if results[0].URL != results[4].URL {
+		t.Errorf("expected identical files in one batch to share a URL, got %s and %s", results[0].URL, results[4].URL)
+	}
+	if results[0].Duplicate == results[4].Duplicate {
+		t.Errorf("expected exactly one of two identical files to be marked duplicate")
+	}
+	if results[3].URL == "" || results[3].Duplicate || results[3].DeleteToken == "" {
+		t.Errorf("expected a fresh upload for the fourth file, got %+v", results[3])
+	}
+
+	if s.images.Count() != 3 {
+		t.Errorf("expected 3 stored images, got %d", s.images.Count())
+	}
+
+	// The error result shouldn't carry empty upload fields
+	if strings.Contains(rr.Body.String(), `"url":""`) {
+		t.Errorf("failed results should omit url, got %s", rr.Body.String())
+	}
+}
+
+func TestBatchUploadPlainText(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := serve(s, batchRequest(t, "file", [][]byte{testPNG(t, 120), []byte("nope")}))
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", rr.Body.String())
+	}
+	if !strings.Contains(lines[0], "/i/") {
+		t.Errorf("expected a URL on the first line, got %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "error: ") {
+		t.Errorf("expected an error on the second line, got %q", lines[1])
+	}
+}
+
+func TestSingleFileStaysSingle(t *testing.T) {
+	s := newTestServer(t)
+
+	req := batchRequest(t, "file", [][]byte{testPNG(t, 130)})
+	req.Header.Set("Accept", "application/json")
+	rr := serve(s, req)
+	if !strings.HasPrefix(rr.Body.String(), "{") {
+		t.Errorf("expected a single JSON object for one file, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,148 @@
+package grombley
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+)
+
+// newDeleteToken returns a random deletion token and the hash we store for it
+func newDeleteToken() (string, string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkDeleteToken reports whether token unlocks deletion of rec
+func checkDeleteToken(rec hashRecord, token string) bool {
+	if rec.DeleteToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(rec.DeleteToken)) == 1
+}
+
+// removeImage deletes a stored image and its cached thumbnails and drops it
+// from the index
+func (s *Server) removeImage(name string) error {
+	err := s.storage.Delete(context.Background(), name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing %s: %w", name, err)
+	}
+	if err := s.thumbs.invalidate(name); err != nil {
+		fmt.Printf("Error removing thumbnails of %s: %v\n", name, err)
+	}
+	return s.images.Remove(name)
+}
+
+// authorizeDelete looks up imageName and checks token against it, writing an
+// error response and returning false if deletion isn't allowed
+func (s *Server) authorizeDelete(w http.ResponseWriter, r *http.Request, imageName string, token string) bool {
+	if err := validateImageName(imageName, s.config.UploadPath); err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
+	}
+
+	rec, ok := s.images.LookupName(imageName)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Image not found")
+		return false
+	}
+
+	// A delete-scoped API token can remove anything
+	if s.tokenAllows(r, scopeDelete) {
+		return true
+	}
+	if !checkDeleteToken(rec, token) {
+		writeError(w, r, http.StatusForbidden, errCodeInvalidToken, "Invalid delete token")
+		return false
+	}
+	return true
+}
+
+// Delete an image: DELETE /i/<name> with the token in X-Delete-Token or
+// ?token=, or an API token with the delete scope
+func (s *Server) deleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	imageName := filepath.Base(r.URL.Path)
+
+	token := r.Header.Get("X-Delete-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	if !s.authorizeDelete(w, r, imageName, token) {
+		return
+	}
+
+	if err := s.removeImage(imageName); err != nil {
+		fmt.Println("Error deleting image:", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error deleting image")
+		return
+	}
+
+	if s.config.Debug {
+		fmt.Printf("Deleted %s\n", imageName)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Browser-friendly delete link: GET /d/<name>?token= shows a confirmation
+// page and the form on it POSTs back here to actually delete. Deleting on GET
+// would let link previews in chat clients wipe images.
+func (s *Server) deletePageHandler(w http.ResponseWriter, r *http.Request) {
+	imageName := filepath.Base(r.URL.Path)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	token := r.FormValue("token")
+	if !s.authorizeDelete(w, r, imageName, token) {
+		return
+	}
+
+	page := struct {
+		Name     string
+		ImageURL string
+		Token    string
+		Deleted  bool
+	}{
+		Name:     imageName,
+		ImageURL: s.config.ServePath + imageName,
+		Token:    token,
+	}
+
+	if r.Method == http.MethodPost {
+		if err := s.removeImage(imageName); err != nil {
+			fmt.Println("Error deleting image:", err)
+			writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error deleting image")
+			return
+		}
+		page.Deleted = true
+	}
+
+	tmpl, err := template.ParseFS(templatesFolder, "templates/delete.html")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal Server Error")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl.Execute(w, page)
+}
@@ -0,0 +1,125 @@
+package grombley
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// uploadJSON uploads data and decodes the JSON response
+func uploadJSON(t *testing.T, s *Server, data []byte) uploadResult {
+	t.Helper()
+	req := uploadRequest(t, data)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	var result uploadResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode upload response: %v", err)
+	}
+	return result
+}
+
+func imageNameFromURL(u string) string {
+	return u[strings.LastIndex(u, "/")+1:]
+}
+
+func TestDeleteImage(t *testing.T) {
+	s := newTestServer(t)
+	data := testPNG(t, 30)
+
+	result := uploadJSON(t, s, data)
+	if result.DeleteToken == "" || result.DeleteURL == "" {
+		t.Fatalf("expected delete token and URL in response, got %+v", result)
+	}
+	name := imageNameFromURL(result.URL)
+
+	dupe := uploadJSON(t, s, data)
+	if dupe.DeleteToken != "" {
+		t.Errorf("duplicate upload should not be handed the delete token")
+	}
+
+	del := func(token string) int {
+		req := httptest.NewRequest("DELETE", "/i/"+name, nil)
+		req.Header.Set("X-Delete-Token", token)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := del("wrong"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for wrong token, got %d", code)
+	}
+	if code := del(""); code != http.StatusForbidden {
+		t.Errorf("expected 403 for missing token, got %d", code)
+	}
+	if code := del(result.DeleteToken); code != http.StatusNoContent {
+		t.Fatalf("expected 204 for valid token, got %d", code)
+	}
+
+	if _, err := os.Stat(filepath.Join(s.config.UploadPath, name)); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed from disk", name)
+	}
+	if _, ok := s.images.LookupName(name); ok {
+		t.Errorf("expected %s to be removed from the index", name)
+	}
+	if code := del(result.DeleteToken); code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting twice, got %d", code)
+	}
+
+	// The same content can be uploaded again afterwards
+	again := uploadJSON(t, s, data)
+	if again.URL == result.URL || again.DeleteToken == "" {
+		t.Errorf("expected a fresh upload after delete, got %+v", again)
+	}
+}
+
+func TestDeletePage(t *testing.T) {
+	s := newTestServer(t)
+	result := uploadJSON(t, s, testPNG(t, 40))
+	name := imageNameFromURL(result.URL)
+
+	deleteURL, err := url.Parse(result.DeleteURL)
+	if err != nil {
+		t.Fatalf("bad delete URL %q: %v", result.DeleteURL, err)
+	}
+
+	// Following the link only shows a confirmation page
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", deleteURL.RequestURI(), nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<form") {
+		t.Fatalf("expected confirmation form, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := s.images.LookupName(name); !ok {
+		t.Fatalf("GET on the delete link must not delete the image")
+	}
+
+	form := url.Values{"token": {"nope"}}
+	req := httptest.NewRequest("POST", "/d/"+name, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for wrong token, got %d", rr.Code)
+	}
+
+	form = url.Values{"token": {result.DeleteToken}}
+	req = httptest.NewRequest("POST", "/d/"+name, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "has been deleted") {
+		t.Errorf("expected deletion confirmation, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := s.images.LookupName(name); ok {
+		t.Errorf("expected %s to be removed from the index", name)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package grombley
 
 import (
 	"bytes"
@@ -77,10 +77,46 @@ func stripExifButKeepOrientation(data []byte) ([]byte, error) {
 		return stripExifFromPng(data)
 	}
 
+	if isWebP(data) {
+		return stripExifFromWebP(data, true)
+	}
+
 	// Unknown format, return as-is
 	return data, nil
 }
 
+// stripExif removes EXIF and metadata from images, orientation included
+func stripExif(data []byte) ([]byte, error) {
+	if isJPEG(data) {
+		segments, err := parseJPEG(data)
+		if err != nil {
+			return data, nil
+		}
+		if _, err := segments.DropExif(); err != nil {
+			return data, nil
+		}
+		var b bytes.Buffer
+		if err := segments.Write(&b); err != nil {
+			return data, fmt.Errorf("failed to write modified JPEG: %w", err)
+		}
+		return b.Bytes(), nil
+	}
+
+	if isPNG(data) {
+		chunks, err := parsePNG(data)
+		if err != nil {
+			return data, nil
+		}
+		return rebuildPngWithOrientation(chunks, 1, false)
+	}
+
+	if isWebP(data) {
+		return stripExifFromWebP(data, false)
+	}
+
+	return data, nil
+}
+
 func stripExifFromJpeg(data []byte) ([]byte, error) {
 	segments, err := parseJPEG(data)
 	if err != nil {
@@ -245,52 +281,15 @@ func getImageOrientation(data []byte) uint16 {
 		}
 	}
 
-	return 1
-}
-
-// addOrientationTag adds an EXIF orientation tag to an image
-func addOrientationTag(data []byte, orientation uint16) ([]byte, error) {
-	if isJPEG(data) {
-		segments, err := parseJPEG(data)
+	if isWebP(data) {
+		chunks, err := parseWebP(data)
 		if err != nil {
-			return data, nil
-		}
-
-		// Drop existing EXIF if any
-		segments.DropExif()
-
-		// Create minimal EXIF with orientation
-		rootIb, err := buildOrientationExif(orientation)
-		if err != nil {
-			return data, nil
-		}
-		err = segments.SetExif(rootIb)
-		if err != nil {
-			return data, nil
-		}
-
-		var b bytes.Buffer
-		segments.Write(&b)
-		return b.Bytes(), nil
-	}
-
-	if isPNG(data) {
-		chunks, err := parsePNG(data)
-		if err != nil {
-			return data, nil
+			return 1
 		}
-
-		// Create minimal EXIF with orientation
-		rootIb, err := buildOrientationExif(orientation)
-		if err != nil {
-			return data, nil
+		if exifData, ok := webpExif(chunks); ok {
+			return extractOrientation(exifData)
 		}
-		_ = chunks.SetExif(rootIb)
-
-		var b bytes.Buffer
-		chunks.WriteTo(&b)
-		return b.Bytes(), nil
 	}
 
-	return data, nil
+	return 1
 }
@@ -0,0 +1,175 @@
+package grombley
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageOrientationPreserved(t *testing.T) {
+	testCases := []struct {
+		name string
+		file string
+	}{
+		{"PNG", "../tests/images/slimer.png"},
+		{"JPEG", "../tests/images/test.jpg"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Read test image
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Skip("Test image not found")
+			}
+
+			// Get original orientation
+			originalOrientation := getImageOrientation(data)
+			t.Logf("Original orientation: %d", originalOrientation)
+
+			// Process the image
+			processed, err := stripExifButKeepOrientation(data)
+			if err != nil {
+				t.Fatalf("Error processing image: %v", err)
+			}
+
+			// Get processed orientation - should always match original
+			processedOrientation := getImageOrientation(processed)
+			if processedOrientation != originalOrientation {
+				t.Errorf("Orientation mismatch: expected %d, got %d", originalOrientation, processedOrientation)
+			} else {
+				t.Logf("Orientation preserved: %d", processedOrientation)
+			}
+		})
+	}
+}
+
+// withOrientation returns a JPEG or PNG with just an EXIF orientation tag
+func withOrientation(t *testing.T, data []byte, orientation uint16) []byte {
+	t.Helper()
+	rootIb, err := buildOrientationExif(orientation)
+	if err != nil {
+		t.Fatalf("failed to build EXIF: %v", err)
+	}
+
+	var b bytes.Buffer
+	if isJPEG(data) {
+		segments, err := parseJPEG(data)
+		if err != nil {
+			t.Fatalf("failed to parse JPEG: %v", err)
+		}
+		segments.DropExif()
+		if err := segments.SetExif(rootIb); err != nil {
+			t.Fatalf("failed to set EXIF: %v", err)
+		}
+		segments.Write(&b)
+	} else {
+		chunks, err := parsePNG(data)
+		if err != nil {
+			t.Fatalf("failed to parse PNG: %v", err)
+		}
+		if err := chunks.SetExif(rootIb); err != nil {
+			t.Fatalf("failed to set EXIF: %v", err)
+		}
+		chunks.WriteTo(&b)
+	}
+
+	if got := getImageOrientation(b.Bytes()); got != orientation {
+		t.Fatalf("test image has orientation %d, want %d", got, orientation)
+	}
+	return b.Bytes()
+}
+
+// sidewaysPNG is a 40x20 PNG, red on the left and blue on the right, tagged
+// as needing a clockwise turn to display upright
+func sidewaysPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.NRGBA{255, 0, 0, 255}
+			if x >= 20 {
+				c = color.NRGBA{0, 0, 255, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+	return withOrientation(t, buf.Bytes(), 6)
+}
+
+// checkUpright decodes data and checks it's sidewaysPNG turned upright: w
+// by h, red at the top and blue at the bottom, with no orientation tag
+func checkUpright(t *testing.T, data []byte, w, h int) {
+	t.Helper()
+	if o := getImageOrientation(data); o != 1 {
+		t.Errorf("expected no orientation tag, got %d", o)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode image: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != w || b.Dy() != h {
+		t.Fatalf("image is %dx%d, want %dx%d", b.Dx(), b.Dy(), w, h)
+	}
+	top := color.NRGBAModel.Convert(img.At(w/2, 0)).(color.NRGBA)
+	bottom := color.NRGBAModel.Convert(img.At(w/2, h-1)).(color.NRGBA)
+	if top.R < 200 || top.B > 50 || bottom.B < 200 || bottom.R > 50 {
+		t.Errorf("expected red at the top and blue at the bottom, got %v and %v", top, bottom)
+	}
+}
+
+func TestThumbnailOrientationBaked(t *testing.T) {
+	s := newTestServer(t)
+	name := imageNameFromURL(uploadJSON(t, s, sidewaysPNG(t)).URL)
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("thumbnail failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	checkUpright(t, rr.Body.Bytes(), 5, 10)
+
+	// The box is turned with the image, so it comes out the size asked for
+	s.thumbSizes[thumbSize{8, 16}] = true
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name+"?w=8&h=16", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("sized thumbnail failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	checkUpright(t, rr.Body.Bytes(), 8, 16)
+}
+
+func TestNormalizeOrientationOnUpload(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{NormalizeOrientation: true})
+	name := imageNameFromURL(uploadJSON(t, s, sidewaysPNG(t)).URL)
+
+	stored, err := os.ReadFile(filepath.Join(s.config.UploadPath, name))
+	if err != nil {
+		t.Fatalf("stored image missing: %v", err)
+	}
+	checkUpright(t, stored, 20, 40)
+
+	// Upright images are only stripped, keeping their original pixels
+	data, err := os.ReadFile("../tests/images/test.jpg")
+	if err != nil {
+		t.Fatalf("failed to read test image: %v", err)
+	}
+	normalized, err := normalizeOrientation(withOrientation(t, data, 1))
+	if err != nil {
+		t.Fatalf("normalizeOrientation failed: %v", err)
+	}
+	stripped, _ := stripExif(data)
+	if !bytes.Equal(normalized, stripped) {
+		t.Errorf("expected an upright JPEG to be stripped without re-encoding")
+	}
+}
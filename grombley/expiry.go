@@ -0,0 +1,181 @@
+package grombley
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reapInterval is how often the background reaper looks for expired uploads
+const reapInterval = time.Minute
+
+// expiryHeader lets any upload endpoint set an expiry without touching the body
+const expiryHeader = "X-Expires"
+
+// ttlValue accepts an expiry given either as a JSON string ("7d", "36h") or a
+// plain number of seconds
+type ttlValue string
+
+func (v *ttlValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = ttlValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("expires must be a string or a number of seconds")
+	}
+	*v = ttlValue(n.String())
+	return nil
+}
+
+// ttlNever is parseTTL's answer to "never": unlike leaving the expiry out,
+// it keeps default_ttl from applying
+const ttlNever time.Duration = -1
+
+// parseTTL understands Go durations ("36h", "90m"), whole days ("7d"), a
+// bare number of seconds and "never"
+func parseTTL(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if strings.EqualFold(value, "never") {
+		return ttlNever, nil
+	}
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid expiry %q", value)
+		}
+		return scaleTTL(value, n, 24*time.Hour)
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("invalid expiry %q", value)
+		}
+		return scaleTTL(value, seconds, time.Second)
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid expiry %q", value)
+	}
+	return ttl, nil
+}
+
+// scaleTTL multiplies n by unit, refusing anything too long for a Duration
+// rather than letting it wrap around to a negative (already expired) TTL
+func scaleTTL(value string, n int64, unit time.Duration) (time.Duration, error) {
+	if n > math.MaxInt64/int64(unit) {
+		return 0, fmt.Errorf("expiry %q is too long", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// requestTTL works out how long an upload should live. value comes from the
+// request body (form field or JSON key) and falls back to the X-Expires
+// header. No expiry means the server default; anything beyond the server
+// maximum is clamped to it. A zero result means the upload never expires.
+func (s *Server) requestTTL(r *http.Request, value string) (time.Duration, error) {
+	if value == "" {
+		value = r.Header.Get(expiryHeader)
+	}
+
+	ttl, err := parseTTL(value)
+	if err != nil {
+		return 0, err
+	}
+
+	switch ttl {
+	case 0:
+		ttl = s.config.DefaultTTL
+	case ttlNever:
+		ttl = 0
+	}
+	if s.config.MaxTTL > 0 && (ttl == 0 || ttl > s.config.MaxTTL) {
+		ttl = s.config.MaxTTL
+	}
+	return ttl, nil
+}
+
+// expiresAt turns a TTL into an absolute expiry; zero means never
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl).UTC().Truncate(time.Second)
+}
+
+// expired reports whether rec has an expiry that has passed
+func (rec hashRecord) expired(now time.Time) bool {
+	return !rec.Expires.IsZero() && !now.Before(rec.Expires)
+}
+
+// outlives reports whether an upload expiring at a would still be around when
+// one expiring at b is gone
+func outlives(a, b time.Time) bool {
+	if a.IsZero() {
+		return !b.IsZero()
+	}
+	return !b.IsZero() && a.After(b)
+}
+
+// checkExpired writes a 410 and returns true if imageName has expired
+func (s *Server) checkExpired(w http.ResponseWriter, r *http.Request, imageName string) bool {
+	rec, ok := s.images.LookupName(imageName)
+	if !ok || !rec.expired(time.Now()) {
+		return false
+	}
+	writeError(w, r, http.StatusGone, errCodeExpired, "Image has expired")
+	return true
+}
+
+// reapExpired deletes every upload whose expiry is at or before now
+func (s *Server) reapExpired(now time.Time) {
+	var expired []string
+	s.images.Range(func(name string, rec hashRecord) bool {
+		if rec.expired(now) {
+			expired = append(expired, name)
+		}
+		return true
+	})
+
+	for _, name := range expired {
+		if err := s.removeImage(name); err != nil {
+			fmt.Printf("Error reaping expired image %s: %v\n", name, err)
+			continue
+		}
+		if s.config.Debug {
+			fmt.Printf("Reaped expired image %s\n", name)
+		}
+	}
+}
+
+// runReaper periodically removes expired uploads and abandoned resumable
+// uploads until stop is closed
+func (s *Server) runReaper(stop <-chan struct{}) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	s.reapExpired(time.Now())
+	s.tus.reapStale(time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.reapExpired(now)
+			s.tus.reapStale(now)
+			s.uploadLimiter.sweep(now)
+			s.thumbLimiter.sweep(now)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package grombley
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"", 0, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"36h", 36 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"3600", time.Hour, false},
+		{"-1", 0, true},
+		{"-5m", 0, true},
+		{"xd", 0, true},
+		{"soon", 0, true},
+		{"never", ttlNever, false},
+		{" Never ", ttlNever, false},
+		{"106751d", 106751 * 24 * time.Hour, false},
+		{"200000d", 0, true},
+		{"9223372036", 9223372036 * time.Second, false},
+		{"9223372037", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseTTL(tc.value)
+		if (err != nil) != tc.err {
+			t.Errorf("parseTTL(%q) error = %v, want error %v", tc.value, err, tc.err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseTTL(%q) = %s, want %s", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestRequestTTL(t *testing.T) {
+	s := &Server{config: Config{DefaultTTL: 24 * time.Hour, MaxTTL: 7 * 24 * time.Hour}}
+
+	testCases := []struct {
+		name   string
+		value  string
+		header string
+		want   time.Duration
+	}{
+		{"default when unset", "", "", 24 * time.Hour},
+		{"body value", "2d", "", 48 * time.Hour},
+		{"header fallback", "", "1h", time.Hour},
+		{"body wins over header", "2h", "1h", 2 * time.Hour},
+		{"clamped to max", "30d", "", 7 * 24 * time.Hour},
+		{"never clamped to max", "never", "", 7 * 24 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/upload", nil)
+			if tc.header != "" {
+				req.Header.Set(expiryHeader, tc.header)
+			}
+			got, err := s.requestTTL(req, tc.value)
+			if err != nil {
+				t.Fatalf("requestTTL returned %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	// Without a maximum, no expiry means forever
+	s = &Server{}
+	if got, _ := s.requestTTL(httptest.NewRequest("POST", "/upload", nil), ""); got != 0 {
+		t.Errorf("expected no expiry, got %s", got)
+	}
+
+	// Nor does a default stop an upload asking to be kept forever
+	s = &Server{config: Config{DefaultTTL: 24 * time.Hour}}
+	if got, _ := s.requestTTL(httptest.NewRequest("POST", "/upload", nil), "never"); got != 0 {
+		t.Errorf("expected never to override the default, got %s", got)
+	}
+}
+
+func uploadWithExpiry(t *testing.T, s *Server, data []byte, expires string) uploadResult {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("expires", expires)
+	part, _ := mw.CreateFormFile("file", "upload.png")
+	part.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	var result uploadResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// expireNow backdates an image's expiry so it counts as expired
+func expireNow(t *testing.T, s *Server, name string) {
+	t.Helper()
+	rec, ok := s.images.LookupName(name)
+	if !ok {
+		t.Fatalf("%s not in index", name)
+	}
+	rec.Expires = time.Now().Add(-time.Second)
+	if _, err := s.images.Add(name, rec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiringUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	result := uploadWithExpiry(t, s, testPNG(t, 50), "1h")
+	if result.Expires == "" {
+		t.Fatalf("expected expiry in response, got %+v", result)
+	}
+	name := imageNameFromURL(result.URL)
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/i/"+name, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 before expiry, got %d", rr.Code)
+	}
+
+	expireNow(t, s, name)
+
+	for _, path := range []string{"/i/" + name, "/t/" + name} {
+		rr = httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusGone {
+			t.Errorf("expected 410 for %s after expiry, got %d", path, rr.Code)
+		}
+	}
+
+	s.reapExpired(time.Now())
+
+	if _, err := os.Stat(filepath.Join(s.config.UploadPath, name)); !os.IsNotExist(err) {
+		t.Errorf("expected reaper to remove %s", name)
+	}
+	if _, ok := s.images.LookupName(name); ok {
+		t.Errorf("expected reaper to evict %s from the index", name)
+	}
+}
+
+func TestExpiryOfDuplicates(t *testing.T) {
+	s := newTestServer(t)
+	data := testPNG(t, 60)
+
+	first := uploadWithExpiry(t, s, data, "1h")
+	name := imageNameFromURL(first.URL)
+
+	// A longer-lived duplicate extends the expiry
+	second := uploadWithExpiry(t, s, data, "2h")
+	if second.URL != first.URL {
+		t.Fatalf("expected duplicate to reuse %s, got %s", first.URL, second.URL)
+	}
+	if second.Expires <= first.Expires {
+		t.Errorf("expected expiry to be extended past %s, got %s", first.Expires, second.Expires)
+	}
+
+	// A shorter-lived one doesn't shorten it
+	third := uploadWithExpiry(t, s, data, "1m")
+	if third.Expires != second.Expires {
+		t.Errorf("expected expiry to stay %s, got %s", second.Expires, third.Expires)
+	}
+
+	// Once expired, the same content is stored afresh
+	expireNow(t, s, name)
+	fresh := uploadWithExpiry(t, s, data, "1h")
+	if fresh.URL == first.URL || fresh.DeleteToken == "" {
+		t.Errorf("expected a new upload after expiry, got %+v", fresh)
+	}
+}
+
+func TestURLUploadExpiry(t *testing.T) {
+	png := testPNG(t, 70)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	defer remote.Close()
+
+	s := newTestServerWithConfig(t, Config{FetchAllow: []string{"127.0.0.1"}})
+
+	body := `{"url": "` + remote.URL + `/shot.png", "expires": 7200}`
+	req := httptest.NewRequest("POST", "/url", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("URL upload failed with %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var result uploadResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	name := imageNameFromURL(result.URL)
+	rec, ok := s.images.LookupName(name)
+	if !ok {
+		t.Fatalf("%s not in index", name)
+	}
+	if d := time.Until(rec.Expires); d < time.Hour || d > 2*time.Hour {
+		t.Errorf("expected expiry about 2h away, got %s", d)
+	}
+}
+
+func TestReaperStopsOnShutdown(t *testing.T) {
+	s, err := New(Config{UploadPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown hung waiting for the reaper")
+	}
+}
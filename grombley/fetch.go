@@ -0,0 +1,254 @@
+package grombley
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Defaults for fetching remote images in /url uploads
+const (
+	defaultFetchConnectTimeout = 5 * time.Second
+	defaultFetchTimeout        = 30 * time.Second
+	defaultFetchMaxBytes       = 32 << 20
+	defaultFetchMaxRedirects   = 5
+)
+
+var (
+	errFetchScheme    = errors.New("only http and https URLs can be fetched")
+	errFetchBlocked   = errors.New("destination address is not allowed")
+	errFetchRedirects = errors.New("too many redirects")
+	errFetchTooLarge  = errors.New("remote file is too large")
+	errFetchURL       = errors.New("invalid URL")
+)
+
+// remoteStatusError is a non-2xx response from the remote server
+type remoteStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *remoteStatusError) Error() string {
+	return "remote server responded with " + e.Status
+}
+
+// blockedPrefixes are address ranges a URL upload must never reach unless
+// allowlisted: anything that isn't the public internet, following the IANA
+// special-purpose address registries.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("10.0.0.0/8"),      // RFC 1918
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local, including cloud metadata
+	netip.MustParsePrefix("172.16.0.0/12"),   // RFC 1918
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation (TEST-NET-1)
+	netip.MustParsePrefix("192.168.0.0/16"),  // RFC 1918
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation (TEST-NET-2)
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation (TEST-NET-3)
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, broadcast
+	netip.MustParsePrefix("::/128"),          // unspecified
+	netip.MustParsePrefix("::1/128"),         // loopback
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, can reach private IPv4
+	netip.MustParsePrefix("2001::/32"),       // Teredo, embeds an IPv4 address
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, embeds an IPv4 address
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// addressPolicy decides which resolved addresses URL uploads may connect to
+type addressPolicy struct {
+	allow []netip.Prefix
+}
+
+func newAddressPolicy(allow []string) (*addressPolicy, error) {
+	prefixes, err := parsePrefixes("fetch_allow", allow)
+	if err != nil {
+		return nil, err
+	}
+	return &addressPolicy{allow: prefixes}, nil
+}
+
+// parsePrefixes parses a config list of CIDRs; a bare address means just
+// that address
+func parsePrefixes(key string, entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range entries {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid %s entry %q: %w", key, cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (p *addressPolicy) allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// control runs after DNS resolution, right before connecting, so it sees the
+// address actually being dialed. Checking here rather than resolving up
+// front means a hostname can't pass the check and then rebind elsewhere.
+func (p *addressPolicy) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !p.allowed(addr) {
+		return fmt.Errorf("%w: %s", errFetchBlocked, addr)
+	}
+	return nil
+}
+
+func checkFetchScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errFetchScheme
+	}
+	return nil
+}
+
+// newFetchClient builds the HTTP client used for URL uploads
+func newFetchClient(config Config) (*http.Client, error) {
+	policy, err := newAddressPolicy(config.FetchAllow)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout: config.FetchConnectTimeout,
+		Control: policy.control,
+	}
+
+	transport := &http.Transport{
+		// No proxy: the address check has to see the real destination
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   config.FetchConnectTimeout,
+		ResponseHeaderTimeout: config.FetchTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	maxRedirects := *config.FetchMaxRedirects
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.FetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return errFetchRedirects
+			}
+			// The new address is checked again when it's dialed
+			return checkFetchScheme(req.URL)
+		},
+	}, nil
+}
+
+// fetchURL downloads a remote file for a URL upload, refusing anything larger
+// than FetchMaxBytes or MaxUploadBytes
+func (s *Server) fetchURL(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFetchURL, err)
+	}
+	if err := checkFetchScheme(u); err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errFetchURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.fetcher.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Error pages aren't images, whatever they happen to contain
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &remoteStatusError{resp.StatusCode, resp.Status}
+	}
+
+	limit := min(s.config.FetchMaxBytes, s.config.MaxUploadBytes)
+	if resp.ContentLength > limit {
+		return nil, errFetchTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errFetchTooLarge
+	}
+	return data, nil
+}
+
+// fetchErrorStatus picks the status, error code and message for a failed fetch
+func fetchErrorStatus(err error) (int, string, string) {
+	var remoteErr *remoteStatusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, errFetchScheme):
+		return http.StatusBadRequest, errCodeInvalidURL, "Only http and https URLs are supported"
+	case errors.Is(err, errFetchURL):
+		return http.StatusBadRequest, errCodeInvalidURL, "Invalid URL"
+	case errors.Is(err, errFetchBlocked):
+		return http.StatusForbidden, errCodeURLNotAllowed, "URL not allowed"
+	case errors.Is(err, errFetchRedirects):
+		return http.StatusBadGateway, errCodeTooManyRedirects, "Too many redirects"
+	case errors.Is(err, errFetchTooLarge):
+		return http.StatusRequestEntityTooLarge, errCodeTooLarge, "Remote file is too large"
+	case errors.As(err, &remoteErr):
+		// A 4xx means the URL itself is bad; a 5xx is the remote's problem
+		status := http.StatusBadGateway
+		if remoteErr.StatusCode >= 400 && remoteErr.StatusCode < 500 {
+			status = http.StatusUnprocessableEntity
+		}
+		return status, errCodeRemoteStatus, "Remote server responded with " + remoteErr.Status
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, errCodeFetchTimeout, "Timed out fetching URL"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return http.StatusUnprocessableEntity, errCodeUnknownHost, "Unknown host"
+	default:
+		return http.StatusBadGateway, errCodeFetchFailed, "Error fetching URL"
+	}
+}
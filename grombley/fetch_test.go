@@ -0,0 +1,253 @@
+package grombley
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// urlUpload posts a URL upload and returns the recorder
+func urlUpload(s *Server, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/url", strings.NewReader(`{"url": "`+target+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	return serve(s, req)
+}
+
+func TestAddressPolicy(t *testing.T) {
+	policy, err := newAddressPolicy([]string{"10.1.0.0/16", "192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"10.0.0.1", false},
+		{"172.20.0.1", false},
+		{"192.168.0.1", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::1", false},
+		{"192.0.2.10", false},
+		{"198.18.0.1", false},
+		{"198.51.100.10", false},
+		{"203.0.113.10", false},
+		{"2001:db8::1", false},
+		{"2001:0:4136:e378:8000:63bf:f5ff:fffe", false},
+		{"10.1.2.3", true},
+		{"192.168.1.5", true},
+		{"192.168.1.6", false},
+	}
+
+	for _, tc := range testCases {
+		if got := policy.allowed(netip.MustParseAddr(tc.addr)); got != tc.allowed {
+			t.Errorf("allowed(%s) = %v, want %v", tc.addr, got, tc.allowed)
+		}
+	}
+
+	if _, err := newAddressPolicy([]string{"not-a-cidr"}); err == nil {
+		t.Errorf("expected invalid allowlist entry to be rejected")
+	}
+}
+
+func TestURLUploadBlocksPrivateAddresses(t *testing.T) {
+	hits := 0
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte("secret metadata"))
+	}))
+	defer remote.Close()
+
+	s := newTestServer(t)
+
+	rr := urlUpload(s, remote.URL+"/latest/meta-data")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for loopback URL, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Hostnames are checked after resolution
+	rr = urlUpload(s, strings.Replace(remote.URL, "127.0.0.1", "localhost", 1))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for localhost URL, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if hits != 0 {
+		t.Errorf("blocked server was contacted %d times", hits)
+	}
+}
+
+func TestURLUploadAllowlist(t *testing.T) {
+	png := testPNG(t, 160)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	defer remote.Close()
+
+	s := newTestServerWithConfig(t, Config{FetchAllow: []string{"127.0.0.1/32"}})
+
+	rr := urlUpload(s, remote.URL+"/shot.png")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/i/") {
+		t.Fatalf("expected allowlisted fetch to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestURLUploadSchemes(t *testing.T) {
+	s := newTestServer(t)
+	for _, target := range []string{"file:///etc/passwd", "ftp://example.com/a.png", "gopher://example.com/"} {
+		if rr := urlUpload(s, target); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", target, rr.Code)
+		}
+	}
+}
+
+func TestURLUploadRedirects(t *testing.T) {
+	png := testPNG(t, 170)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	})
+	mux.HandleFunc("/hop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/image.png", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/inside", func(w http.ResponseWriter, r *http.Request) {
+		// 127.0.0.2 is loopback too, but outside the allowlist
+		http.Redirect(w, r, "http://127.0.0.2:9/", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	remote := httptest.NewServer(mux)
+	defer remote.Close()
+
+	maxRedirects := 3
+	s := newTestServerWithConfig(t, Config{FetchAllow: []string{"127.0.0.1"}, FetchMaxRedirects: &maxRedirects})
+
+	if rr := urlUpload(s, remote.URL+"/hop"); rr.Code != http.StatusOK {
+		t.Errorf("expected a single redirect to be followed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := urlUpload(s, remote.URL+"/loop"); rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "redirects") {
+		t.Errorf("expected redirect loop to be cut off, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := urlUpload(s, remote.URL+"/inside"); rr.Code != http.StatusForbidden {
+		t.Errorf("expected redirect to a blocked address to be refused, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := urlUpload(s, remote.URL+"/file"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected redirect to file:// to be refused, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	noRedirects := 0
+	s = newTestServerWithConfig(t, Config{FetchAllow: []string{"127.0.0.1"}, FetchMaxRedirects: &noRedirects})
+	if rr := urlUpload(s, remote.URL+"/hop"); rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "redirects") {
+		t.Errorf("expected fetch_max_redirects = 0 to refuse any redirect, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := urlUpload(s, remote.URL+"/image.png"); rr.Code != http.StatusOK {
+		t.Errorf("expected fetch without a redirect to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestURLUploadLimits(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 2048))
+	})
+	mux.HandleFunc("/big-chunked", func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length, so the limit has to be enforced while reading
+		for i := 0; i < 16; i++ {
+			w.Write(bytes.Repeat([]byte("x"), 256))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	remote := httptest.NewServer(mux)
+	defer remote.Close()
+
+	s := newTestServerWithConfig(t, Config{
+		FetchAllow:    []string{"127.0.0.1"},
+		FetchMaxBytes: 1024,
+		FetchTimeout:  200 * time.Millisecond,
+	})
+
+	for _, path := range []string{"/big", "/big-chunked"} {
+		if rr := urlUpload(s, remote.URL+path); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413 for %s, got %d: %s", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	start := time.Now()
+	rr := urlUpload(s, remote.URL+"/slow")
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 for a slow fetch, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected fetch to time out quickly, took %s", elapsed)
+	}
+}
+
+func TestURLUploadRemoteStatus(t *testing.T) {
+	png := testPNG(t, 180)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/missing.png", func(w http.ResponseWriter, r *http.Request) {
+		// An error page that happens to be an image is still an error
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(png)
+	})
+	mux.HandleFunc("/broken.png", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	remote := httptest.NewServer(mux)
+	defer remote.Close()
+
+	s := newTestServerWithConfig(t, Config{FetchAllow: []string{"127.0.0.1"}})
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/missing.png", http.StatusUnprocessableEntity},
+		{"/broken.png", http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		rr := urlUpload(s, remote.URL+tc.path)
+		if rr.Code != tc.status {
+			t.Errorf("expected %d for %s, got %d: %s", tc.status, tc.path, rr.Code, rr.Body.String())
+		}
+	}
+
+	if s.images.Count() != 0 {
+		t.Errorf("expected nothing to be stored from error responses, got %d images", s.images.Count())
+	}
+}
+
+func TestURLUploadBadRequests(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, body := range []string{"", "not json", `{"url": ""}`, `{"url": "http://"}`} {
+		req := httptest.NewRequest("POST", "/url", strings.NewReader(body))
+		if rr := serve(s, req); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for body %q, got %d: %s", body, rr.Code, rr.Body.String())
+		}
+	}
+}
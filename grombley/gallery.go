@@ -0,0 +1,287 @@
+package grombley
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type MimeTypeHandler struct {
+	mimeToExt map[string]string
+	extToMime map[string]string
+}
+
+var supportedMimeTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+func newMimeTypeHandler() *MimeTypeHandler {
+	mimeToExt := supportedMimeTypes
+
+	extToMime := make(map[string]string, len(mimeToExt))
+	for mime, ext := range mimeToExt {
+		extToMime["."+ext] = mime
+		if mime == "image/jpeg" {
+			extToMime[".jpeg"] = mime
+		}
+	}
+
+	return &MimeTypeHandler{
+		mimeToExt: mimeToExt,
+		extToMime: extToMime,
+	}
+}
+
+func (m *MimeTypeHandler) detectContentType(file io.Reader) (string, io.Reader, error) {
+	buffer := make([]byte, 512)
+	n, err := file.Read(buffer)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+
+	contentType := http.DetectContentType(buffer[:n])
+	combinedReader := io.MultiReader(bytes.NewReader(buffer[:n]), file)
+
+	ext, ok := m.mimeToExt[contentType]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported type: %s", contentType)
+	}
+
+	return "." + ext, combinedReader, nil
+}
+
+func (m *MimeTypeHandler) getContentType(filename string) string {
+	ext := filepath.Ext(filename)
+	if mime, ok := m.extToMime[ext]; ok {
+		return mime
+	}
+	return "application/octet-stream"
+}
+
+func randfilename(length int, extension string) string {
+	letterRunes := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	randomRunes := make([]rune, length)
+	// The package-level source is safe for concurrent use; a per-call source
+	// seeded from the clock hands out identical names to parallel uploads.
+	for index := range randomRunes {
+		randomRunes[index] = letterRunes[rand.Intn(len(letterRunes))]
+	}
+	return string(randomRunes) + extension
+}
+
+// uploadError is a failed upload along with the status, error code and
+// message to give the client
+type uploadError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.Err
+}
+
+// uploadOptions are the per-request settings for storing an upload
+type uploadOptions struct {
+	// TTL is how long the upload lives; zero means forever
+	TTL time.Duration
+	// NameHint is an optional client-supplied filename worked into the stored name
+	NameHint string
+}
+
+func (s *Server) writeFileAndReturnURL(w http.ResponseWriter, r *http.Request, file io.Reader, opts uploadOptions) error {
+	result, err := s.storeImage(r, file, opts)
+	if err != nil {
+		writeUploadError(w, r, err)
+		return err
+	}
+	return respondWithFileURL(w, r, result)
+}
+
+// storeImage dedups an upload against the index, or detects its type, strips
+// its metadata and saves it under a new random name
+func (s *Server) storeImage(r *http.Request, file io.Reader, opts uploadOptions) (uploadResult, error) {
+
+	// Hashing reads the whole file, so it has to be rewindable afterwards
+	if _, ok := file.(io.Seeker); !ok {
+		data, err := io.ReadAll(file)
+		if isTooLarge(err) {
+			return uploadResult{}, &uploadError{http.StatusRequestEntityTooLarge, errCodeTooLarge, s.tooLargeMessage(), err}
+		}
+		if err != nil {
+			return uploadResult{}, &uploadError{http.StatusBadRequest, errCodeInvalidRequest, "Error reading file", err}
+		}
+		file = bytes.NewReader(data)
+	}
+
+	hash, err := computeFileHash(file)
+	if err != nil {
+		return uploadResult{}, &uploadError{http.StatusBadRequest, errCodeInvalidRequest, "Error reading file", err}
+	}
+	expires := expiresAt(opts.TTL)
+	value, exists := s.images.Lookup(hash)
+
+	// An expired copy the reaper hasn't got to yet doesn't count
+	if exists {
+		if rec, ok := s.images.LookupName(value); ok && rec.expired(time.Now()) {
+			if err := s.removeImage(value); err != nil {
+				fmt.Printf("Error removing expired image %s: %v\n", value, err)
+			}
+			exists = false
+		}
+	}
+
+	if exists {
+		if s.config.Debug {
+			fmt.Printf("Hash %s exists: %s\n", hash, value)
+		}
+		// Don't let a short-lived upload take a longer-lived duplicate with it
+		if rec, ok := s.images.LookupName(value); ok && outlives(expires, rec.Expires) {
+			rec.Expires = expires
+			if err := s.storage.SetMeta(r.Context(), value, rec.meta()); err != nil {
+				fmt.Printf("Error extending expiry of %s: %v\n", value, err)
+			} else if _, err := s.images.Add(value, rec); err != nil {
+				fmt.Printf("Error extending expiry of %s: %v\n", value, err)
+			}
+		}
+		result := s.newUploadResult(s.constructFileURL(r, value), value)
+		result.Duplicate = true
+		return result, nil
+	}
+
+	if s.config.Debug {
+		fmt.Printf("Hash %s does not exist\n", hash)
+	}
+	// Only the header is read here; nothing decodes the whole image until
+	// its dimensions are known to be sane
+	if err := s.checkPixels(file.(io.ReadSeeker)); err != nil {
+		return uploadResult{}, &uploadError{http.StatusRequestEntityTooLarge, errCodeTooLarge, s.tooManyPixelsMessage(), err}
+	}
+
+	ext, fileReader, err := s.mimeTypes.detectContentType(file)
+	if err != nil {
+		return uploadResult{}, &uploadError{http.StatusBadRequest, errCodeUnsupportedType, "Unsupported file type", err}
+	}
+
+	genfilename := randfilename(6, ext)
+	if stem := sanitizeNameHint(opts.NameHint); stem != "" {
+		genfilename = stem + "-" + genfilename
+	}
+
+	token, tokenHash, err := newDeleteToken()
+	if err != nil {
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, errCodeInternal, "Error processing file", err}
+	}
+
+	data, err := s.processImage(fileReader, ext)
+	if err != nil {
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, errCodeInternal, "Error processing file", err}
+	}
+
+	uploader, _ := requestUploader(r)
+	release, err := s.quotas.reserve(uploader, int64(len(data)))
+	if err != nil {
+		return uploadResult{}, &uploadError{http.StatusTooManyRequests, errCodeQuotaExceeded, "Daily upload quota exceeded", err}
+	}
+
+	meta := fileMeta{Hash: hash, DeleteToken: tokenHash, Expires: expires, Uploader: uploader}
+	if err := s.storage.Put(r.Context(), genfilename, bytes.NewReader(data), meta); err != nil {
+		release()
+		fmt.Printf("Error storing %s: %v\n", genfilename, err)
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, errCodeInternal, "Error processing file", err}
+	}
+
+	info, err := s.storage.Stat(r.Context(), genfilename)
+	if err != nil {
+		release()
+		s.storage.Delete(context.Background(), genfilename)
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, errCodeInternal, "Error processing file", err}
+	}
+	rec := fileRecord(info, meta)
+
+	// Another request may have stored the same image while we were busy
+	stored, err := s.images.Add(genfilename, rec)
+	if err != nil {
+		fmt.Printf("Error recording %s in hash index: %v\n", genfilename, err)
+		stored = genfilename
+	}
+	if stored != genfilename {
+		release()
+		s.storage.Delete(context.Background(), genfilename)
+		result := s.newUploadResult(s.constructFileURL(r, stored), stored)
+		result.Duplicate = true
+		return result, nil
+	}
+
+	result := s.newUploadResult(s.constructFileURL(r, stored), stored)
+	result.DeleteURL = s.constructDeleteURL(r, stored, token)
+	result.DeleteToken = token
+	return result, nil
+}
+
+// processImage returns what gets stored for an upload
+func (s *Server) processImage(src io.Reader, ext string) ([]byte, error) {
+	// For GIF files, just save as-is (animated GIFs shouldn't be re-encoded)
+	if ext == ".gif" {
+		return io.ReadAll(src)
+	}
+
+	if s.config.NormalizeOrientation {
+		raw, err := io.ReadAll(src)
+		if err != nil {
+			return nil, fmt.Errorf("error processing image: %w", err)
+		}
+		data, err := normalizeOrientation(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error processing image: %w", err)
+		}
+		return data, nil
+	}
+
+	// Strip EXIF and metadata:
+	data, err := stripExifButKeepOrientationFromReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("error processing image: %w", err)
+	}
+	return data, nil
+}
+
+// validateImageName checks for path traversal, empty names, and allowed extensions
+func validateImageName(imageName string, uploadPath string) error {
+	if imageName == "" || imageName == "." || imageName == ".." {
+		return fmt.Errorf("invalid file name")
+	}
+
+	if strings.HasPrefix(imageName, ".") {
+		return fmt.Errorf("invalid file name")
+	}
+
+	imagePath := filepath.Join(uploadPath, imageName)
+	absImagePath, err := filepath.Abs(imagePath)
+	absUploadPath, err2 := filepath.Abs(uploadPath)
+	if err != nil || err2 != nil || !strings.HasPrefix(absImagePath, absUploadPath) {
+		return fmt.Errorf("invalid file path")
+	}
+
+	ext := strings.ToLower(filepath.Ext(imageName))
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return nil
+	default:
+		return fmt.Errorf("unsupported file type")
+	}
+}
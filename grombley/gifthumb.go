@@ -0,0 +1,247 @@
+package grombley
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"math"
+)
+
+// Animated GIFs get animated thumbnails: every frame is scaled on its own
+// and keeps its position, delay and disposal, so the thumbnail plays just
+// like the original. GIFs with more frames or pixels than the limits below
+// get a still of their first frame instead, as does ?static=1.
+
+const (
+	maxGIFThumbFrames = 300
+	// maxGIFThumbPixels caps the pixels of all frames added together
+	maxGIFThumbPixels = 100_000_000
+)
+
+var errBadGIF = errors.New("malformed GIF")
+
+// isGIF checks if the data is a GIF image
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+// scanGIF counts a GIF's frames and their pixels by walking its blocks,
+// without decompressing anything
+func scanGIF(data []byte) (frames int, pixels int64, err error) {
+	// Header and logical screen descriptor
+	if len(data) < 13 {
+		return 0, 0, errBadGIF
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+
+	// skipSubBlocks moves past a run of data sub-blocks and its terminator
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return errBadGIF
+			}
+			size := int(data[pos])
+			pos++
+			if size == 0 {
+				return nil
+			}
+			pos += size
+		}
+	}
+
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return 0, 0, errBadGIF
+			}
+			w := int64(data[pos+5]) | int64(data[pos+6])<<8
+			h := int64(data[pos+7]) | int64(data[pos+8])<<8
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			pos++ // LZW minimum code size
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+			frames++
+			pixels += w * h
+		case 0x3B: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, errBadGIF
+		}
+	}
+	// Plenty of GIFs in the wild are missing their trailer
+	return frames, pixels, nil
+}
+
+// animatedGIFThumbnail makes an animated thumbnail of a GIF. It returns false
+// without an error if the GIF isn't animated or is too big to animate, and
+// the caller should make a still instead.
+func animatedGIFThumbnail(data []byte, spec thumbSpec) ([]byte, bool, error) {
+	frames, pixels, err := scanGIF(data)
+	if err != nil || frames < 2 || frames > maxGIFThumbFrames || pixels > maxGIFThumbPixels {
+		return nil, false, nil
+	}
+
+	src, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+
+	canvas := image.Rect(0, 0, src.Config.Width, src.Config.Height)
+	crop, newW, newH := thumbGeometry(canvas, spec, 4)
+	scaleX := float64(newW) / float64(crop.Dx())
+	scaleY := float64(newH) / float64(crop.Dy())
+
+	dst := &gif.GIF{
+		Image:           make([]*image.Paletted, len(src.Image)),
+		Delay:           src.Delay,
+		Disposal:        src.Disposal,
+		LoopCount:       src.LoopCount,
+		BackgroundIndex: src.BackgroundIndex,
+		Config: image.Config{
+			ColorModel: src.Config.ColorModel,
+			Width:      newW,
+			Height:     newH,
+		},
+	}
+
+	for i, frame := range src.Image {
+		visible := frame.Rect.Intersect(crop)
+		if visible.Empty() {
+			// Nothing of this frame shows, but its delay and disposal still
+			// matter; keep a single transparent pixel in its place
+			dst.Image[i] = transparentFrame(frame.Palette, image.Rect(0, 0, 1, 1))
+			continue
+		}
+
+		// Where the frame lands in the thumbnail
+		x0 := int(math.Floor(float64(visible.Min.X-crop.Min.X) * scaleX))
+		y0 := int(math.Floor(float64(visible.Min.Y-crop.Min.Y) * scaleY))
+		x1 := min(newW, max(x0+1, int(math.Ceil(float64(visible.Max.X-crop.Min.X)*scaleX))))
+		y1 := min(newH, max(y0+1, int(math.Ceil(float64(visible.Max.Y-crop.Min.Y)*scaleY))))
+		x0, y0 = min(x0, newW-1), min(y0, newH-1)
+		rect := image.Rect(x0, y0, x1, y1)
+
+		scaled := resizeImage(frame, visible, rect.Dx(), rect.Dy()).(*image.RGBA)
+		dst.Image[i] = quantize(scaled, frame.Palette, rect.Min)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, dst); err != nil {
+		return nil, false, fmt.Errorf("error encoding GIF thumbnail: %w", err)
+	}
+	return buf.Bytes(), true, nil
+}
+
+// transparentIndex finds the palette entry used for transparency, if any
+func transparentIndex(palette color.Palette) int {
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// transparentFrame is a fully transparent frame covering rect
+func transparentFrame(palette color.Palette, rect image.Rectangle) *image.Paletted {
+	palette = withTransparency(palette)
+	frame := image.NewPaletted(rect, palette)
+	idx := uint8(transparentIndex(palette))
+	for i := range frame.Pix {
+		frame.Pix[i] = idx
+	}
+	return frame
+}
+
+// withTransparency returns palette with a transparent entry, adding one (or
+// giving up the last color for it) if needed
+func withTransparency(palette color.Palette) color.Palette {
+	if transparentIndex(palette) >= 0 {
+		return palette
+	}
+	out := make(color.Palette, len(palette), len(palette)+1)
+	copy(out, palette)
+	if len(out) < 256 {
+		return append(out, color.RGBA{})
+	}
+	out[len(out)-1] = color.RGBA{}
+	return out
+}
+
+// quantize maps a scaled frame back onto a palette, placing it at origin.
+// Mostly transparent pixels become the transparent entry.
+func quantize(img *image.RGBA, palette color.Palette, origin image.Point) *image.Paletted {
+	b := img.Bounds()
+	hasTransparency := false
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] < 0x80 {
+			hasTransparency = true
+			break
+		}
+	}
+	if hasTransparency {
+		palette = withTransparency(palette)
+	}
+	transparent := transparentIndex(palette)
+
+	// Opaque colors that only differ in their low bits share a lookup
+	var lookup [1 << 15]int16
+	dst := image.NewPaletted(b.Sub(b.Min).Add(origin), palette)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			if p[3] < 0x80 && transparent >= 0 {
+				dst.Pix[y*dst.Stride+x] = uint8(transparent)
+				continue
+			}
+			c := color.RGBA{p[0], p[1], p[2], 0xff}
+			if p[3] != 0xff {
+				// Undo premultiplication for partly covered edge pixels
+				c.R = uint8(uint32(p[0]) * 0xff / uint32(p[3]))
+				c.G = uint8(uint32(p[1]) * 0xff / uint32(p[3]))
+				c.B = uint8(uint32(p[2]) * 0xff / uint32(p[3]))
+			}
+			key := int(c.R>>3)<<10 | int(c.G>>3)<<5 | int(c.B>>3)
+			if lookup[key] == 0 {
+				lookup[key] = int16(opaqueIndex(palette, c)) + 1
+			}
+			dst.Pix[y*dst.Stride+x] = uint8(lookup[key] - 1)
+		}
+	}
+	return dst
+}
+
+// opaqueIndex is palette.Index that never picks the transparent entry
+func opaqueIndex(palette color.Palette, c color.RGBA) int {
+	best, bestDist := 0, math.MaxInt
+	for i, pc := range palette {
+		r, g, b, a := pc.RGBA()
+		if a == 0 {
+			continue
+		}
+		dr := int(r>>8) - int(c.R)
+		dg := int(g>>8) - int(c.G)
+		db := int(b>>8) - int(c.B)
+		if dist := dr*dr + dg*dg + db*db; dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
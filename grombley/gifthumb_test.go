@@ -0,0 +1,130 @@
+package grombley
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testGIF is a 40x40 animation: a full red frame, then a blue square in the
+// middle that is cleared afterwards, then a full green frame
+func testGIF(t *testing.T) []byte {
+	t.Helper()
+	palette := color.Palette{
+		color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255},
+	}
+	frame := func(rect image.Rectangle, index uint8) *image.Paletted {
+		img := image.NewPaletted(rect, palette)
+		for i := range img.Pix {
+			img.Pix[i] = index
+		}
+		return img
+	}
+
+	anim := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 40, 40), 0),
+			frame(image.Rect(10, 10, 30, 30), 1),
+			frame(image.Rect(0, 0, 40, 40), 2),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		LoopCount: 2,
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("failed to encode test GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestScanGIF(t *testing.T) {
+	data := testGIF(t)
+	frames, pixels, err := scanGIF(data)
+	if err != nil {
+		t.Fatalf("scanGIF failed: %v", err)
+	}
+	if frames != 3 || pixels != 40*40*2+20*20 {
+		t.Errorf("scanGIF = %d frames, %d pixels; want 3, %d", frames, pixels, 40*40*2+20*20)
+	}
+
+	if _, _, err := scanGIF(data[:len(data)/2]); err == nil {
+		t.Error("expected a truncated GIF to be rejected")
+	}
+}
+
+func TestAnimatedGIFThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	name := imageNameFromURL(uploadJSON(t, s, testGIF(t)).URL)
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("thumbnail failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/gif" {
+		t.Fatalf("expected Content-Type image/gif, got %s", ct)
+	}
+
+	thumb, err := gif.DecodeAll(rr.Body)
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	}
+	if thumb.Config.Width != 10 || thumb.Config.Height != 10 {
+		t.Errorf("thumbnail is %dx%d, want 10x10", thumb.Config.Width, thumb.Config.Height)
+	}
+	if len(thumb.Image) != 3 {
+		t.Fatalf("thumbnail has %d frames, want 3", len(thumb.Image))
+	}
+	if thumb.LoopCount != 2 {
+		t.Errorf("expected loop count 2, got %d", thumb.LoopCount)
+	}
+	for i, want := range []int{10, 20, 30} {
+		if thumb.Delay[i] != want {
+			t.Errorf("frame %d has delay %d, want %d", i, thumb.Delay[i], want)
+		}
+	}
+	if thumb.Disposal[1] != gif.DisposalBackground {
+		t.Errorf("expected frame 1 to keep its disposal, got %d", thumb.Disposal[1])
+	}
+	if r := thumb.Image[1].Rect; r != image.Rect(2, 2, 8, 8) {
+		t.Errorf("frame 1 is at %v, want (2,2)-(8,8)", r)
+	}
+	if r, _, b, _ := thumb.Image[1].At(5, 5).RGBA(); r != 0 || b != 0xffff {
+		t.Errorf("expected frame 1 to stay blue")
+	}
+}
+
+func TestStaticGIFThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	name := imageNameFromURL(uploadJSON(t, s, testGIF(t)).URL)
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name+"?static=1", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("thumbnail failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("expected Content-Type image/png, got %s", ct)
+	}
+	img, _, err := image.Decode(rr.Body)
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 10 || b.Dy() != 10 {
+		t.Errorf("thumbnail is %dx%d, want 10x10", b.Dx(), b.Dy())
+	}
+	if r, g, _, _ := img.At(5, 5).RGBA(); r != 0xffff || g != 0 {
+		t.Errorf("expected the first, red frame")
+	}
+
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name+"?static=maybe", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad static value, got %d", rr.Code)
+	}
+}
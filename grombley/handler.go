@@ -0,0 +1,246 @@
+package grombley
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// notfoundHandler shows Fenton, or a problem+json 404 to API clients
+func notfoundHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Not found")
+		return
+	}
+	tmpl, err := template.ParseFS(templatesFolder, "templates/404.html")
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	tmpl.Execute(w, nil)
+}
+
+func (s *Server) livezHandler(w http.ResponseWriter, req *http.Request) {
+	_, verbose := req.URL.Query()["verbose"]
+	if !verbose {
+		fmt.Fprintf(w, "200")
+		return
+	}
+	// Print extra info if verbose is present http://foo.bar:3000/livez?verbose
+	fmt.Fprintf(w, "Server is running on http://%s\n", s.config.Bind)
+	fmt.Fprintf(w, "Serving images at %s\n", s.config.ServePath)
+	fmt.Fprintf(w, "Upload path is %s\n", s.config.UploadPath)
+	fmt.Fprintf(w, "%d image hashes in memory\n", s.images.Count())
+}
+
+func (s *Server) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(w, "200")
+}
+
+// Serve original image
+func (s *Server) serveImageHandler(w http.ResponseWriter, r *http.Request) {
+	imageName := filepath.Base(r.URL.Path)
+
+	if err := validateImageName(imageName, s.config.UploadPath); err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if s.checkExpired(w, r, imageName) {
+		return
+	}
+
+	// Set the Content-Type header based on the file extension.
+	contentType := s.mimeTypes.getContentType(imageName)
+
+	// Send a smaller WebP copy to clients that take it. Only indexed images
+	// get one, since deleting through the index is what cleans it up.
+	if negotiateWebP(w, r, contentType) {
+		if _, indexed := s.images.LookupName(imageName); indexed {
+			data, ok := s.webpVariant(imageName, "webp", func() ([]byte, error) {
+				imageFile, err := s.storage.Get(r.Context(), imageName)
+				if err != nil {
+					return nil, err
+				}
+				defer imageFile.Close()
+				return io.ReadAll(imageFile)
+			})
+			if ok {
+				w.Header().Set("Content-Type", "image/webp")
+				s.serveImageContent(w, r, imageName, "webp", bytes.NewReader(data))
+				return
+			}
+		}
+	}
+
+	// A client revalidating an image it has doesn't need it fetched from
+	// storage, which for S3 means downloading the whole object
+	if rec, ok := s.images.LookupName(imageName); ok && etagMatches(r.Header.Get("If-None-Match"), imageETag(rec.Hash, "")) {
+		setCacheHeaders(w.Header(), rec, "", time.Now())
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Open the image file.
+	imageFile, err := s.storage.Get(r.Context(), imageName)
+	if err != nil {
+		notfoundHandler(w, r)
+		return
+	}
+	defer imageFile.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	s.serveImageContent(w, r, imageName, "", imageFile)
+}
+
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if isRawUpload(r) {
+		s.rawUploadHandler(w, r)
+		return
+	}
+
+	s.limitBody(w, r)
+
+	// Parse the multipart form data with a specified max memory limit (in bytes)
+	if err := r.ParseMultipartForm(10 << 20); isTooLarge(err) { // 10 MB max in-memory size
+		writeError(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, s.tooLargeMessage())
+		return
+	}
+
+	// Several files (or anything in the "files" field) make it a batch
+	if files := batchFiles(r); files != nil {
+		s.batchUploadHandler(w, r, files)
+		return
+	}
+
+	// Get the uploaded file
+	file, _, err := r.FormFile("file") // "file" should match the name attribute in your HTML form
+	if err != nil {
+		fmt.Println("Error retrieving the file:", err)
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Error retrieving the file")
+		return
+	}
+	defer file.Close()
+
+	ttl, err := s.requestTTL(r, r.FormValue("expires"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	s.writeFileAndReturnURL(w, r, file, uploadOptions{TTL: ttl})
+}
+
+func (s *Server) urlUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var requestBody struct {
+		URL     string   `json:"url"`
+		Expires ttlValue `json:"expires"`
+	}
+	s.limitBody(w, r)
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		if isTooLarge(err) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, s.tooLargeMessage())
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Invalid JSON body")
+		return
+	}
+	urlString := requestBody.URL
+	if urlString == "" {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Missing url")
+		return
+	}
+
+	ttl, err := s.requestTTL(r, string(requestBody.Expires))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	data, err := s.fetchURL(r.Context(), urlString)
+	if err != nil {
+		if s.config.Debug {
+			fmt.Printf("Error fetching %s: %v\n", urlString, err)
+		}
+		status, code, message := fetchErrorStatus(err)
+		writeError(w, r, status, code, message)
+		return
+	}
+
+	s.writeFileAndReturnURL(w, r, bytes.NewReader(data), uploadOptions{TTL: ttl})
+}
+
+// uploadResult is what we tell the client about a stored image. The delete
+// token is only handed out to whoever first uploaded the image.
+type uploadResult struct {
+	URL         string `json:"url"`
+	DeleteURL   string `json:"delete_url,omitempty"`
+	DeleteToken string `json:"delete_token,omitempty"`
+	Expires     string `json:"expires,omitempty"`
+	// Duplicate is set when the content was already stored
+	Duplicate bool `json:"duplicate"`
+}
+
+// newUploadResult describes a stored image, including when it expires
+func (s *Server) newUploadResult(fileURL string, filename string) uploadResult {
+	result := uploadResult{URL: fileURL}
+	if rec, ok := s.images.LookupName(filename); ok && !rec.Expires.IsZero() {
+		result.Expires = rec.Expires.Format(time.RFC3339)
+	}
+	return result
+}
+
+// constructURL returns an absolute link to path on this server, as clients
+// see it
+func (s *Server) constructURL(r *http.Request, path string) string {
+	scheme, host := s.requestOrigin(r)
+	return fmt.Sprintf("%s://%s%s", scheme, host, path)
+}
+
+func (s *Server) constructFileURL(r *http.Request, filename string) string {
+	return s.constructURL(r, s.config.ServePath+filename)
+}
+
+func (s *Server) constructDeleteURL(r *http.Request, filename string, token string) string {
+	return s.constructURL(r, "/d/"+filename+"?token="+url.QueryEscape(token))
+}
+
+func respondWithFileURL(w http.ResponseWriter, r *http.Request, result uploadResult) error {
+	switch {
+	case wantsJSON(r):
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(result)
+		if err != nil {
+			http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
+			return err
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err := w.Write([]byte(result.URL + "\n"))
+		if err != nil {
+			http.Error(w, "Failed to write plain text response", http.StatusInternalServerError)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package grombley
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+)
+
+// buildHashDict reconciles the persistent index with the contents of store.
+// Files whose size and modification time match their stored record keep the
+// stored hash; only new or changed files are rehashed.
+func buildHashDict(store storage, db *hashDB) (*ImageIndex, error) {
+	known, err := db.records()
+	if err != nil {
+		return nil, fmt.Errorf("error reading hash index: %v", err)
+	}
+
+	files, err := store.List(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error listing stored images: %v", err)
+	}
+
+	current := make(map[string]hashRecord)
+	changed := make(map[string]hashRecord)
+	seen := make(map[string]bool)
+
+	for _, info := range files {
+		name := info.Name
+		seen[name] = true
+
+		rec, ok := known[name]
+		if !ok || rec.Size != info.Size || !rec.ModTime.Equal(info.ModTime) {
+			// Listings may not carry the metadata stored with the file
+			if info.Meta == nil {
+				if info, err = store.Stat(context.Background(), name); err != nil {
+					return nil, fmt.Errorf("error reading %s: %v", name, err)
+				}
+			}
+
+			if info.Meta != nil {
+				// What's stored with the file is the latest word, since
+				// another instance sharing the storage may have changed it
+				rec = fileRecord(info, *info.Meta)
+			} else {
+				hashString := info.Hash
+				if hashString == "" {
+					hashString, err = hashFile(store, name)
+					if err != nil {
+						return nil, fmt.Errorf("error hashing %s: %v", name, err)
+					}
+				}
+				// Keep anything else we know about the file (delete token, etc.)
+				rec.Hash, rec.Size, rec.ModTime = hashString, info.Size, info.ModTime
+			}
+			changed[name] = rec
+		}
+
+		current[name] = rec
+	}
+
+	var removed []string
+	for name := range known {
+		if !seen[name] {
+			removed = append(removed, name)
+		}
+	}
+
+	if err := db.delete(removed...); err != nil {
+		return nil, fmt.Errorf("error pruning hash index: %v", err)
+	}
+	if err := db.put(changed); err != nil {
+		return nil, fmt.Errorf("error updating hash index: %v", err)
+	}
+
+	index := newImageIndex(db)
+	index.load(current)
+	return index, nil
+}
+
+// fileRecord builds the index record for a stored file
+func fileRecord(info fileInfo, meta fileMeta) hashRecord {
+	return hashRecord{
+		Hash:        meta.Hash,
+		Size:        info.Size,
+		ModTime:     info.ModTime,
+		DeleteToken: meta.DeleteToken,
+		Expires:     meta.Expires,
+		Uploader:    meta.Uploader,
+	}
+}
+
+// meta is the part of rec that's kept with the file where the storage can
+func (rec hashRecord) meta() fileMeta {
+	return fileMeta{Hash: rec.Hash, DeleteToken: rec.DeleteToken, Expires: rec.Expires, Uploader: rec.Uploader}
+}
+
+func hashFile(store storage, name string) (string, error) {
+	file, err := store.Get(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return computeFileHash(file)
+}
+
+func computeFileHash(fileReader io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, fileReader); err != nil {
+		return "", err
+	}
+	hashInBytes := hash.Sum(nil)[:16]
+	hashString := fmt.Sprintf("%x", hashInBytes)
+
+	if seeker, ok := fileReader.(io.Seeker); ok {
+		_, err := seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hashString, nil
+}
@@ -0,0 +1,96 @@
+package grombley
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildHashDictReconcile(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := openHashDB(filepath.Join(dir, hashIndexFile))
+	if err != nil {
+		t.Fatalf("failed to open hash index: %v", err)
+	}
+	defer db.Close()
+
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	writeFile("aaaaaa.png", "first")
+	writeFile("bbbbbb.png", "second")
+
+	index, err := buildHashDict(newFSStorage(dir), db)
+	if err != nil {
+		t.Fatalf("buildHashDict failed: %v", err)
+	}
+	if index.Count() != 2 {
+		t.Fatalf("expected 2 hashes, got %d", index.Count())
+	}
+	if name, _ := index.Lookup("8b04d5e3775d298e78455efc5ca404d5"); name != "aaaaaa.png" {
+		t.Errorf("expected md5 of \"first\" to map to aaaaaa.png, got %q", name)
+	}
+
+	t.Run("unchanged files are not rehashed", func(t *testing.T) {
+		// Plant a fake hash; if the file isn't rehashed it survives
+		info, err := os.Stat(filepath.Join(dir, "aaaaaa.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.put(map[string]hashRecord{
+			"aaaaaa.png": {Hash: "planted", Size: info.Size(), ModTime: info.ModTime()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index, err := buildHashDict(newFSStorage(dir), db)
+		if err != nil {
+			t.Fatalf("buildHashDict failed: %v", err)
+		}
+		if name, _ := index.Lookup("planted"); name != "aaaaaa.png" {
+			t.Errorf("expected stored hash to be reused, got %q", name)
+		}
+	})
+
+	t.Run("modified files are rehashed", func(t *testing.T) {
+		writeFile("aaaaaa.png", "changed")
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(filepath.Join(dir, "aaaaaa.png"), later, later)
+
+		index, err := buildHashDict(newFSStorage(dir), db)
+		if err != nil {
+			t.Fatalf("buildHashDict failed: %v", err)
+		}
+		if _, ok := index.Lookup("planted"); ok {
+			t.Errorf("expected planted hash to be replaced")
+		}
+		if index.Count() != 2 {
+			t.Errorf("expected 2 hashes, got %d", index.Count())
+		}
+	})
+
+	t.Run("deleted files are pruned", func(t *testing.T) {
+		os.Remove(filepath.Join(dir, "bbbbbb.png"))
+
+		if _, err := buildHashDict(newFSStorage(dir), db); err != nil {
+			t.Fatalf("buildHashDict failed: %v", err)
+		}
+		records, err := db.records()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := records["bbbbbb.png"]; ok {
+			t.Errorf("expected bbbbbb.png to be pruned from the index")
+		}
+		if _, ok := records[hashIndexFile]; ok {
+			t.Errorf("index file should not index itself")
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package grombley
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// hashIndexFile is the name of the persistent hash index kept in the upload directory
+const hashIndexFile = ".grombley.db"
+
+var (
+	filesBucket  = []byte("files")
+	hashesBucket = []byte("hashes")
+)
+
+// hashRecord is what we remember about a file between restarts
+type hashRecord struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// DeleteToken is the SHA-256 of the token handed to the uploader
+	DeleteToken string `json:"delete_token,omitempty"`
+	// Expires is when the reaper may remove the file; zero means never
+	Expires time.Time `json:"expires,omitzero"`
+	// Uploader names the API token or signed-in user that uploaded the file
+	Uploader string `json:"uploader,omitempty"`
+}
+
+// hashDB is an on-disk index of uploaded files. Records are keyed by filename
+// so they can be reconciled against the upload directory, and a second bucket
+// maps content hashes back to filenames.
+type hashDB struct {
+	db *bolt.DB
+}
+
+func openHashDB(path string) (*hashDB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening hash index %q: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, hashesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing hash index %q: %w", path, err)
+	}
+
+	return &hashDB{db: db}, nil
+}
+
+func (h *hashDB) Close() error {
+	return h.db.Close()
+}
+
+// records returns every file record in the index
+func (h *hashDB) records() (map[string]hashRecord, error) {
+	records := make(map[string]hashRecord)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			var rec hashRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("corrupt record for %q: %w", k, err)
+			}
+			records[string(k)] = rec
+			return nil
+		})
+	})
+	return records, err
+}
+
+// put stores or replaces the records for the given files in a single transaction
+func (h *hashDB) put(records map[string]hashRecord) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(filesBucket)
+		hashes := tx.Bucket(hashesBucket)
+		for name, rec := range records {
+			if err := removeRecord(files, hashes, name); err != nil {
+				return err
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := files.Put([]byte(name), data); err != nil {
+				return err
+			}
+			if err := hashes.Put([]byte(rec.Hash), []byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// delete removes the records for the given files
+func (h *hashDB) delete(names ...string) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(filesBucket)
+		hashes := tx.Bucket(hashesBucket)
+		for _, name := range names {
+			if err := removeRecord(files, hashes, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeRecord drops a file record and its hash entry, if the hash still points at it
+func removeRecord(files, hashes *bolt.Bucket, name string) error {
+	data := files.Get([]byte(name))
+	if data == nil {
+		return nil
+	}
+	var rec hashRecord
+	if err := json.Unmarshal(data, &rec); err == nil {
+		if string(hashes.Get([]byte(rec.Hash))) == name {
+			if err := hashes.Delete([]byte(rec.Hash)); err != nil {
+				return err
+			}
+		}
+	}
+	return files.Delete([]byte(name))
+}
@@ -0,0 +1,63 @@
+package grombley
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Stored images never change: a new upload always gets a new name. So
+// originals, thumbnails and WebP copies of indexed images are served with
+// strong ETags made from the content hash, and caches may keep them for as
+// long as they like. net/http's ServeContent does the conditional and range
+// request handling.
+
+// cacheMaxAge is how long clients may keep an image without asking again
+const cacheMaxAge = 365 * 24 * time.Hour
+
+// imageETag is the ETag for one representation of an image. variant is ""
+// for the original, or the thumbnail cache key of a thumbnail or WebP copy.
+func imageETag(hash, variant string) string {
+	if variant == "" {
+		return `"` + hash + `"`
+	}
+	return `"` + hash + "-" + variant + `"`
+}
+
+// setCacheHeaders marks a response as cacheable until the image expires, if
+// it ever does
+func setCacheHeaders(h http.Header, rec hashRecord, variant string, now time.Time) {
+	maxAge := cacheMaxAge
+	if !rec.Expires.IsZero() {
+		maxAge = min(maxAge, rec.Expires.Sub(now))
+	}
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", max(int64(maxAge/time.Second), 0)))
+	h.Set("ETag", imageETag(rec.Hash, variant))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveImageContent sends a representation of an image, answering
+// conditional and range requests. The Content-Type must already be set.
+func (s *Server) serveImageContent(w http.ResponseWriter, r *http.Request, imageName, variant string, content io.ReadSeeker) {
+	var modTime time.Time
+	if rec, ok := s.images.LookupName(imageName); ok {
+		setCacheHeaders(w.Header(), rec, variant, time.Now())
+		modTime = rec.ModTime
+	} else if info, err := s.storage.Stat(r.Context(), imageName); err == nil {
+		// Not ours to vouch for, but Last-Modified still saves a transfer
+		modTime = info.ModTime
+	}
+	http.ServeContent(w, r, imageName, modTime, content)
+}
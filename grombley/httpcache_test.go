@@ -0,0 +1,155 @@
+package grombley
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getWithHeaders(s *Server, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{"*", true},
+		{`"abc-160x160-contain"`, false},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, `"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestImageCachingHeaders(t *testing.T) {
+	s := newTestServer(t)
+	data := testPNG(t, 40)
+	name := imageNameFromURL(uploadJSON(t, s, data).URL)
+	rec, _ := s.images.LookupName(name)
+
+	rr := getWithHeaders(s, "/i/"+name, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("request failed with %d", rr.Code)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag != `"`+rec.Hash+`"` {
+		t.Errorf("expected ETag from the content hash, got %s", etag)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("unexpected Cache-Control %q", cc)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != strconv.Itoa(len(data)) {
+		t.Errorf("expected Content-Length %d, got %s", len(data), cl)
+	}
+	lastModified := rr.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Error("expected a Last-Modified header")
+	}
+
+	rr = getWithHeaders(s, "/i/"+name, map[string]string{"If-None-Match": etag})
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("expected an empty 304 for a matching ETag, got %d", rr.Code)
+	}
+	if rr.Header().Get("ETag") != etag {
+		t.Error("expected the 304 to carry the ETag")
+	}
+
+	rr = getWithHeaders(s, "/i/"+name, map[string]string{"If-Modified-Since": lastModified})
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for If-Modified-Since, got %d", rr.Code)
+	}
+
+	rr = getWithHeaders(s, "/i/"+name, map[string]string{"If-None-Match": `"stale"`})
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("expected the image for a stale ETag, got %d", rr.Code)
+	}
+}
+
+func TestImageRangeRequests(t *testing.T) {
+	s := newTestServer(t)
+	data := testPNG(t, 50)
+	name := imageNameFromURL(uploadJSON(t, s, data).URL)
+
+	rr := getWithHeaders(s, "/i/"+name, map[string]string{"Range": "bytes=0-9"})
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", rr.Code)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data[:10]) {
+		t.Error("expected the first ten bytes")
+	}
+	if cr := rr.Header().Get("Content-Range"); !strings.HasPrefix(cr, "bytes 0-9/") {
+		t.Errorf("unexpected Content-Range %q", cr)
+	}
+	if ar := rr.Header().Get("Accept-Ranges"); ar != "bytes" {
+		t.Errorf("expected Accept-Ranges: bytes, got %q", ar)
+	}
+
+	// A range against an old version gets the whole thing
+	rr = getWithHeaders(s, "/i/"+name, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("expected the full image for a stale If-Range, got %d", rr.Code)
+	}
+
+	rr = getWithHeaders(s, "/i/"+name, map[string]string{"Range": "bytes=100000-"})
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected 416 for a range past the end, got %d", rr.Code)
+	}
+}
+
+func TestThumbnailCachingHeaders(t *testing.T) {
+	s := newTestServer(t)
+	name := imageNameFromURL(uploadJSON(t, s, testPNG(t, 60)).URL)
+	rec, _ := s.images.LookupName(name)
+
+	rr := getWithHeaders(s, "/t/"+name, nil)
+	etag := rr.Header().Get("ETag")
+	if etag != `"`+rec.Hash+`-div4"` {
+		t.Errorf("unexpected thumbnail ETag %s", etag)
+	}
+	rr = getWithHeaders(s, "/t/"+name+"?w=160&h=160", nil)
+	if other := rr.Header().Get("ETag"); other == etag || other == "" {
+		t.Errorf("expected a different ETag for another size, got %s", other)
+	}
+
+	rr = getWithHeaders(s, "/t/"+name, map[string]string{"If-None-Match": etag})
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching thumbnail ETag, got %d", rr.Code)
+	}
+}
+
+func TestExpiringImageCacheLifetime(t *testing.T) {
+	rec := hashRecord{Hash: "abc"}
+	now := time.Now()
+
+	h := http.Header{}
+	rec.Expires = now.Add(time.Hour)
+	setCacheHeaders(h, rec, "", now)
+	if cc := h.Get("Cache-Control"); cc != "public, max-age=3600, immutable" {
+		t.Errorf("expected caching to stop at expiry, got %q", cc)
+	}
+
+	rec.Expires = now.Add(-time.Minute)
+	setCacheHeaders(h, rec, "", now)
+	if cc := h.Get("Cache-Control"); cc != "public, max-age=0, immutable" {
+		t.Errorf("expected no caching after expiry, got %q", cc)
+	}
+}
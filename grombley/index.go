@@ -0,0 +1,123 @@
+package grombley
+
+import (
+	"sync"
+)
+
+// ImageIndex tracks every stored image by content hash and by filename. It is
+// safe for concurrent use and, when backed by a hashDB, writes changes through
+// to disk so they survive restarts.
+type ImageIndex struct {
+	mu     sync.RWMutex
+	db     *hashDB
+	byHash map[string]string
+	byName map[string]hashRecord
+}
+
+func newImageIndex(db *hashDB) *ImageIndex {
+	return &ImageIndex{
+		db:     db,
+		byHash: make(map[string]string),
+		byName: make(map[string]hashRecord),
+	}
+}
+
+// load replaces the in-memory contents without touching the database
+func (i *ImageIndex) load(records map[string]hashRecord) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.byHash = make(map[string]string, len(records))
+	i.byName = make(map[string]hashRecord, len(records))
+	for name, rec := range records {
+		i.byHash[rec.Hash] = name
+		i.byName[name] = rec
+	}
+}
+
+// Lookup returns the filename stored under a content hash
+func (i *ImageIndex) Lookup(hash string) (string, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	name, ok := i.byHash[hash]
+	return name, ok
+}
+
+// LookupName returns the record for a stored filename
+func (i *ImageIndex) LookupName(name string) (hashRecord, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	rec, ok := i.byName[name]
+	return rec, ok
+}
+
+// Add records name under rec.Hash. If another file already holds that hash
+// nothing is stored and the existing filename is returned instead, so callers
+// racing to store the same content can discard their copy.
+func (i *ImageIndex) Add(name string, rec hashRecord) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if existing, ok := i.byHash[rec.Hash]; ok && existing != name {
+		return existing, nil
+	}
+
+	if i.db != nil {
+		if err := i.db.put(map[string]hashRecord{name: rec}); err != nil {
+			return "", err
+		}
+	}
+
+	if old, ok := i.byName[name]; ok && i.byHash[old.Hash] == name {
+		delete(i.byHash, old.Hash)
+	}
+	i.byHash[rec.Hash] = name
+	i.byName[name] = rec
+	return name, nil
+}
+
+// Remove drops a filename and its hash from the index
+func (i *ImageIndex) Remove(name string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	rec, ok := i.byName[name]
+	if !ok {
+		return nil
+	}
+
+	if i.db != nil {
+		if err := i.db.delete(name); err != nil {
+			return err
+		}
+	}
+
+	if i.byHash[rec.Hash] == name {
+		delete(i.byHash, rec.Hash)
+	}
+	delete(i.byName, name)
+	return nil
+}
+
+// Count returns the number of indexed images
+func (i *ImageIndex) Count() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.byName)
+}
+
+// Range calls fn for every indexed image until fn returns false. The index is
+// read-locked for the duration, so fn must not modify it.
+func (i *ImageIndex) Range(fn func(name string, rec hashRecord) bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for name, rec := range i.byName {
+		if !fn(name, rec) {
+			return
+		}
+	}
+}
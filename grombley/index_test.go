@@ -0,0 +1,187 @@
+package grombley
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testPNG returns a small solid-color PNG; different shades give different hashes
+func testPNG(t *testing.T, shade uint8) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.RGBA{shade, 255 - shade, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// newTestServer starts a Server on a fresh upload directory
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return newTestServerWithConfig(t, Config{})
+}
+
+// newTestServerWithConfig is newTestServer with extra settings
+func newTestServerWithConfig(t *testing.T, config Config) *Server {
+	t.Helper()
+	config.UploadPath = t.TempDir()
+	s, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func uploadRequest(t *testing.T, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "upload.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestImageIndex(t *testing.T) {
+	index := newImageIndex(nil)
+
+	if name, err := index.Add("aaaaaa.png", hashRecord{Hash: "h1"}); err != nil || name != "aaaaaa.png" {
+		t.Fatalf("Add returned %q, %v", name, err)
+	}
+	if name, _ := index.Add("bbbbbb.png", hashRecord{Hash: "h1"}); name != "aaaaaa.png" {
+		t.Errorf("expected duplicate hash to return existing file, got %q", name)
+	}
+	if _, ok := index.LookupName("bbbbbb.png"); ok {
+		t.Errorf("duplicate should not have been stored")
+	}
+	if rec, ok := index.LookupName("aaaaaa.png"); !ok || rec.Hash != "h1" {
+		t.Errorf("LookupName returned %v, %v", rec, ok)
+	}
+
+	index.Remove("aaaaaa.png")
+	if _, ok := index.Lookup("h1"); ok {
+		t.Errorf("expected h1 to be removed")
+	}
+	if index.Count() != 0 {
+		t.Errorf("expected empty index, got %d", index.Count())
+	}
+}
+
+func TestImageIndexConcurrentAccess(t *testing.T) {
+	index := newImageIndex(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%d.png", i)
+			index.Add(name, hashRecord{Hash: fmt.Sprintf("hash%d", i%10)})
+			index.Lookup(fmt.Sprintf("hash%d", i))
+			index.LookupName(name)
+			index.Count()
+			index.Range(func(string, hashRecord) bool { return true })
+			if i%3 == 0 {
+				index.Remove(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if index.Count() > 10 {
+		t.Errorf("expected at most one file per hash, got %d", index.Count())
+	}
+}
+
+func TestParallelUploads(t *testing.T) {
+	s := newTestServer(t)
+
+	const distinct = 8
+	const copies = 4
+
+	urls := make([][]string, distinct)
+	for i := range urls {
+		urls[i] = make([]string, copies)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < distinct; i++ {
+		data := testPNG(t, uint8(i*20))
+		for c := 0; c < copies; c++ {
+			wg.Add(1)
+			go func(i, c int) {
+				defer wg.Done()
+				rr := httptest.NewRecorder()
+				s.Handler().ServeHTTP(rr, uploadRequest(t, data))
+				if rr.Code != http.StatusOK {
+					t.Errorf("upload %d/%d: expected 200, got %d", i, c, rr.Code)
+					return
+				}
+				body, _ := io.ReadAll(rr.Body)
+				urls[i][c] = strings.TrimSpace(string(body))
+			}(i, c)
+		}
+	}
+
+	// Hammer the read side while uploads are in flight
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 20; n++ {
+			s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/livez?verbose", nil))
+		}
+	}()
+
+	wg.Wait()
+
+	for i := range urls {
+		for c := 1; c < copies; c++ {
+			if urls[i][c] != urls[i][0] {
+				t.Errorf("image %d: duplicate uploads returned different URLs %q and %q", i, urls[i][0], urls[i][c])
+			}
+		}
+	}
+
+	if s.images.Count() != distinct {
+		t.Errorf("expected %d indexed images, got %d", distinct, s.images.Count())
+	}
+
+	entries, err := os.ReadDir(s.config.UploadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			stored++
+		}
+	}
+	if stored != distinct {
+		t.Errorf("expected %d files on disk, got %d", distinct, stored)
+	}
+}
@@ -0,0 +1,57 @@
+package grombley
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // so GIF dimensions can be checked too
+	"io"
+	"net/http"
+
+	_ "golang.org/x/image/webp" // and WebP's, and WebP thumbnails decoded
+)
+
+// Defaults for the limits on what can be uploaded
+const (
+	defaultMaxUploadBytes = 32 << 20
+	defaultMaxPixels      = 50_000_000
+)
+
+var errTooManyPixels = errors.New("image dimensions exceed the pixel limit")
+
+// limitBody caps how much of the request body a handler will read. Reading
+// past the limit fails with an *http.MaxBytesError.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadBytes)
+}
+
+// isTooLarge reports whether err came from reading past limitBody's limit
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+func (s *Server) tooLargeMessage() string {
+	return fmt.Sprintf("Upload exceeds the limit of %d bytes", s.config.MaxUploadBytes)
+}
+
+func (s *Server) tooManyPixelsMessage() string {
+	return fmt.Sprintf("Image exceeds the limit of %d pixels", s.config.MaxPixels)
+}
+
+// checkPixels reads just the image header and refuses dimensions that would
+// take too much memory to decode. The reader is rewound afterwards.
+func (s *Server) checkPixels(file io.ReadSeeker) error {
+	cfg, _, err := image.DecodeConfig(file)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return seekErr
+	}
+	if err != nil {
+		// Not something we can decode; type detection deals with it
+		return nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > s.config.MaxPixels {
+		return fmt.Errorf("%w: %dx%d", errTooManyPixels, cfg.Width, cfg.Height)
+	}
+	return nil
+}
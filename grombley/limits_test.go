@@ -0,0 +1,118 @@
+package grombley
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// bombPNG is a valid PNG header claiming to be width x height, which is all
+// DecodeConfig looks at
+func bombPNG(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	data := testPNG(t, 200)
+	// IHDR data starts after the signature, chunk length and chunk type
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestUploadByteLimit(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{MaxUploadBytes: 1024})
+	big := append(testPNG(t, 10), bytes.Repeat([]byte{0}, 2048)...)
+
+	raw := httptest.NewRequest("PUT", "/upload", bytes.NewReader(big))
+	// Without a length up front the limit kicks in while reading
+	chunked := httptest.NewRequest("PUT", "/upload", io.MultiReader(bytes.NewReader(big)))
+	chunked.ContentLength = -1
+
+	testCases := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"multipart", uploadRequest(t, big)},
+		{"batch", batchRequest(t, "files", [][]byte{big[:800], big[:800]})},
+		{"raw", raw},
+		{"raw chunked", chunked},
+		{"tus", func() *http.Request {
+			req := tusRequest("POST", "/tus/", nil)
+			req.Header.Set("Upload-Length", "2048")
+			return req
+		}()},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := serve(s, tc.req)
+			if rr.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected 413, got %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	if rr := serve(s, uploadRequest(t, testPNG(t, 20))); rr.Code != http.StatusOK {
+		t.Errorf("Expected an upload under the limit to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if s.images.Count() != 1 {
+		t.Errorf("Expected only the small upload to be stored, got %d images", s.images.Count())
+	}
+}
+
+func TestURLUploadByteLimit(t *testing.T) {
+	big := append(testPNG(t, 30), bytes.Repeat([]byte{0}, 2048)...)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(big)
+	}))
+	defer remote.Close()
+
+	// The smaller of the two limits applies
+	s := newTestServerWithConfig(t, Config{FetchAllow: []string{"127.0.0.1"}, MaxUploadBytes: 1024})
+
+	if rr := urlUpload(s, remote.URL); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPixelLimit(t *testing.T) {
+	s := newTestServer(t)
+
+	req := uploadRequest(t, bombPNG(t, 50000, 50000))
+	req.Header.Set("Accept", "application/json")
+	rr := serve(s, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for a 50000x50000 PNG, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), errCodeTooLarge) || !strings.Contains(rr.Body.String(), "pixels") {
+		t.Errorf("Expected a clear too_large problem, got %s", rr.Body.String())
+	}
+	if s.images.Count() != 0 {
+		t.Errorf("Expected nothing to be stored, got %d images", s.images.Count())
+	}
+}
+
+func TestThumbnailPixelLimit(t *testing.T) {
+	s := newTestServer(t)
+	name := imageNameFromURL(uploadJSON(t, s, testPNG(t, 40)).URL)
+
+	// Stored before the limit was lowered
+	s.config.MaxPixels = 32
+
+	rr := serve(s, httptest.NewRequest("GET", "/t/"+name, nil))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a thumbnail over the pixel limit, got %d", rr.Code)
+	}
+}
+
+func TestTusMaxSize(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{MaxUploadBytes: 4096})
+	rr := serve(s, httptest.NewRequest("OPTIONS", "/tus/", nil))
+	if v := rr.Header().Get("Tus-Max-Size"); v != "4096" {
+		t.Errorf("Expected Tus-Max-Size 4096, got %q", v)
+	}
+}
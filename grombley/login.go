@@ -0,0 +1,270 @@
+package grombley
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// With OIDC configured, the upload page sends visitors to the issuer to sign
+// in (the authorization code flow with PKCE) and, once the ID token checks
+// out, gives them a session cookie signed with SessionSecret. The session
+// lets the page's uploads through; API clients still use API tokens.
+
+const (
+	sessionCookie = "grombley_session"
+	loginCookie   = "grombley_login"
+
+	authLoginPath    = "/auth/login"
+	authCallbackPath = "/auth/callback"
+	authLogoutPath   = "/auth/logout"
+
+	// loginMaxAge is how long a sign-in may take at the issuer
+	loginMaxAge = 10 * time.Minute
+)
+
+// session is what a session cookie vouches for
+type session struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// name is how the user is recorded as an uploader
+func (s session) name() string {
+	if s.Email != "" {
+		return s.Email
+	}
+	return s.Subject
+}
+
+// loginState carries a sign-in from /auth/login to /auth/callback
+type loginState struct {
+	State       string `json:"state"`
+	Nonce       string `json:"nonce"`
+	Verifier    string `json:"verifier"`
+	RedirectURL string `json:"redirect_url"`
+	Return      string `json:"return"`
+	Expires     int64  `json:"exp"`
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// signCookie encodes v as JSON with an HMAC, so it can be handed to the
+// browser and trusted when it comes back
+func (s *Server) signCookie(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// readCookie decodes a cookie made by signCookie into v, reporting false if
+// it's missing or has been tampered with
+func (s *Server) readCookie(r *http.Request, name string, v any) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payload, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// setCookie sets one of our cookies; maxAge < 0 deletes it
+func (s *Server) setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, maxAge int) {
+	scheme, _ := s.requestOrigin(r)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   scheme == "https",
+		// Lax still sends it on the issuer's redirect back to us
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// currentSession returns the request's session, if it has a valid one
+func (s *Server) currentSession(r *http.Request) (session, bool) {
+	if s.oidc == nil {
+		return session{}, false
+	}
+	var sess session
+	if !s.readCookie(r, sessionCookie, &sess) || time.Now().Unix() >= sess.Expires {
+		return session{}, false
+	}
+	return sess, true
+}
+
+// requireLogin sends visitors without a session to sign in first
+func (s *Server) requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.oidc != nil {
+			if _, ok := s.currentSession(r); !ok {
+				http.Redirect(w, r, authLoginPath+"?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// safeReturnPath only allows returning to a path on this server
+func safeReturnPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
+
+// Sign in: GET /auth/login?return=<path> redirects to the issuer
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	state := loginState{
+		Return:      safeReturnPath(r.URL.Query().Get("return")),
+		RedirectURL: s.oidc.config.RedirectURL,
+		Expires:     time.Now().Add(loginMaxAge).Unix(),
+	}
+	if state.RedirectURL == "" {
+		state.RedirectURL = s.constructURL(r, authCallbackPath)
+	}
+	for _, field := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		token, err := randomToken()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal Server Error")
+			return
+		}
+		*field = token
+	}
+
+	authURL, err := s.oidc.authCodeURL(r.Context(), state.RedirectURL, state.State, state.Nonce, state.Verifier)
+	if err != nil {
+		fmt.Printf("Error starting sign-in: %v\n", err)
+		writeError(w, r, http.StatusBadGateway, errCodeLoginFailed, "Sign-in is unavailable")
+		return
+	}
+	value, err := s.signCookie(state)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal Server Error")
+		return
+	}
+	s.setCookie(w, r, loginCookie, value, "/auth/", int(loginMaxAge/time.Second))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// The issuer sends the browser back to GET /auth/callback?code=&state=
+func (s *Server) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	var state loginState
+	if !s.readCookie(r, loginCookie, &state) || time.Now().Unix() >= state.Expires {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Sign-in expired, please try again")
+		return
+	}
+	// Each sign-in is good for one callback
+	s.setCookie(w, r, loginCookie, "", "/auth/", -1)
+
+	q := r.URL.Query()
+	if !hmac.Equal([]byte(q.Get("state")), []byte(state.State)) {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Sign-in state doesn't match")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		writeError(w, r, http.StatusForbidden, errCodeLoginFailed, "Sign-in failed: "+e)
+		return
+	}
+
+	claims, err := s.oidc.exchange(r.Context(), state.RedirectURL, q.Get("code"), state.Verifier, state.Nonce)
+	if err != nil {
+		fmt.Printf("Error completing sign-in: %v\n", err)
+		writeError(w, r, http.StatusBadGateway, errCodeLoginFailed, "Sign-in failed")
+		return
+	}
+	if !s.oidc.allowed(claims) {
+		if s.config.Debug {
+			fmt.Printf("Refused sign-in for %s (%s)\n", claims.Subject, claims.Email)
+		}
+		writeError(w, r, http.StatusForbidden, errCodeForbidden, "You're not allowed to use this server")
+		return
+	}
+
+	sess := session{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Expires: time.Now().Add(s.oidc.config.SessionTTL).Unix(),
+	}
+	value, err := s.signCookie(sess)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal Server Error")
+		return
+	}
+	s.setCookie(w, r, sessionCookie, value, "/", int(s.oidc.config.SessionTTL/time.Second))
+	if s.config.Debug {
+		fmt.Printf("Signed in %s\n", sess.name())
+	}
+	http.Redirect(w, r, state.Return, http.StatusFound)
+}
+
+// Sign out: POST /auth/logout drops the session
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	s.setCookie(w, r, sessionCookie, "", "/", -1)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// allowed checks a signed-in user against the allowlists
+func (p *oidcProvider) allowed(claims *idTokenClaims) bool {
+	if len(p.config.AllowedDomains) == 0 && len(p.config.AllowedGroups) == 0 {
+		return true
+	}
+
+	// Anyone can claim any address they haven't had to prove
+	if claims.EmailVerified != nil && *claims.EmailVerified {
+		if at := strings.LastIndex(claims.Email, "@"); at >= 0 {
+			domain := claims.Email[at+1:]
+			for _, allowed := range p.config.AllowedDomains {
+				if strings.EqualFold(domain, allowed) {
+					return true
+				}
+			}
+		}
+	}
+	for _, group := range claims.Groups {
+		if slices.Contains(p.config.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
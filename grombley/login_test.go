@@ -0,0 +1,427 @@
+package grombley
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID provider: discovery, keys and a token
+// endpoint that checks PKCE and hands back an ID token with whatever claims
+// the test set for the code
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+// mockGrant is what the mock issuer knows about an authorization code
+type mockGrant struct {
+	challenge string
+	claims    map[string]any
+	// signer overrides the issuer's own key, to forge tokens
+	signer *rsa.PrivateKey
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		grant, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.mu.Unlock()
+
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || id != "grombley" || secret != "shh" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		signer := m.key
+		if grant.signer != nil {
+			signer = grant.signer
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signJWT(t, signer, grant.claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// signJWT makes an RS256 JWT
+func signJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// claims returns a valid set of ID token claims for the given nonce
+func (m *mockIssuer) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            m.URL,
+		"sub":            "user-1",
+		"aud":            "grombley",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "pat@example.com",
+		"email_verified": true,
+	}
+}
+
+func newOIDCServer(t *testing.T, issuer *mockIssuer, oidc OIDCConfig) *Server {
+	t.Helper()
+	oidc.Issuer = issuer.URL
+	oidc.ClientID = "grombley"
+	oidc.ClientSecret = "shh"
+	oidc.SessionSecret = "session secret"
+	return newTestServerWithConfig(t, Config{OIDC: oidc})
+}
+
+// signIn runs the login flow, letting edit change the ID token the issuer
+// hands out, and returns the callback's response
+func signIn(t *testing.T, s *Server, issuer *mockIssuer, edit func(grant *mockGrant)) *httptest.ResponseRecorder {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", authLoginPath+"?return=/upload-page", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("login returned %d: %s", rr.Code, rr.Body.String())
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), issuer.URL+"/authorize") {
+		t.Fatalf("login redirected to %q", rr.Header().Get("Location"))
+	}
+	q := location.Query()
+	if q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+		t.Fatalf("unexpected authorization request %v", q)
+	}
+	if q.Get("redirect_uri") != "http://example.com"+authCallbackPath {
+		t.Errorf("unexpected redirect_uri %q", q.Get("redirect_uri"))
+	}
+
+	grant := mockGrant{challenge: q.Get("code_challenge"), claims: issuer.claims(q.Get("nonce"))}
+	if edit != nil {
+		edit(&grant)
+	}
+	issuer.mu.Lock()
+	issuer.codes["the-code"] = grant
+	issuer.mu.Unlock()
+
+	req := httptest.NewRequest("GET", authCallbackPath+"?code=the-code&state="+url.QueryEscape(q.Get("state")), nil)
+	for _, cookie := range rr.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func sessionFrom(t *testing.T, rr *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.MaxAge > 0 {
+			return cookie
+		}
+	}
+	t.Fatalf("no session cookie in response %d: %s", rr.Code, rr.Body.String())
+	return nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	s := newOIDCServer(t, issuer, OIDCConfig{})
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != authLoginPath+"?return=%2F" {
+		t.Fatalf("expected the upload page to send us to sign in, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Other static files and images stay public
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/static/script.js", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected static files to be public, got %d", rr.Code)
+	}
+
+	rr = signIn(t, s, issuer, nil)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/upload-page" {
+		t.Fatalf("expected the callback to send us back, got %d %s: %s", rr.Code, rr.Header().Get("Location"), rr.Body.String())
+	}
+	cookie := sessionFrom(t, rr)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Error("expected an HttpOnly, SameSite=Lax session cookie")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the upload page once signed in, got %d", rr.Code)
+	}
+
+	req = uploadRequest(t, testPNG(t, 100))
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected uploads to need a session, got %d", rr.Code)
+	}
+
+	req = uploadRequest(t, testPNG(t, 100))
+	req.Header.Set("Accept", "application/json")
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the upload to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var result uploadResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := s.images.LookupName(imageNameFromURL(result.URL)); rec.Uploader != "pat@example.com" {
+		t.Errorf("expected the upload to be recorded against the user, got %q", rec.Uploader)
+	}
+
+	// A session that's been tampered with is no session
+	forged := *cookie
+	forged.Value = strings.Replace(cookie.Value, cookie.Value[:4], "AAAA", 1)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&forged)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Errorf("expected a forged session to be refused, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("POST", authLogoutPath, nil)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if c := rr.Result().Cookies(); len(c) != 1 || c[0].Name != sessionCookie || c[0].MaxAge >= 0 {
+		t.Errorf("expected logout to clear the session cookie, got %v", c)
+	}
+}
+
+func TestOIDCAllowlist(t *testing.T) {
+	issuer := newMockIssuer(t)
+	s := newOIDCServer(t, issuer, OIDCConfig{
+		AllowedDomains: []string{"example.com"},
+		AllowedGroups:  []string{"photographers"},
+		GroupsClaim:    "roles",
+	})
+
+	testCases := []struct {
+		name    string
+		edit    func(claims map[string]any)
+		allowed bool
+	}{
+		{"verified email in domain", func(map[string]any) {}, true},
+		{"domain is case-insensitive", func(c map[string]any) { c["email"] = "pat@EXAMPLE.com" }, true},
+		{"other domain", func(c map[string]any) { c["email"] = "pat@example.org" }, false},
+		{"unverified email", func(c map[string]any) { c["email_verified"] = false }, false},
+		{"subdomain trick", func(c map[string]any) { c["email"] = "pat@evil.com@example.org" }, false},
+		{"allowed group", func(c map[string]any) {
+			c["email"] = "pat@example.org"
+			c["roles"] = []string{"staff", "photographers"}
+		}, true},
+		{"single group string", func(c map[string]any) {
+			delete(c, "email")
+			c["roles"] = "photographers"
+		}, true},
+		{"other group", func(c map[string]any) {
+			c["email"] = "pat@example.org"
+			c["roles"] = []string{"staff"}
+		}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := signIn(t, s, issuer, func(g *mockGrant) { tc.edit(g.claims) })
+			if tc.allowed && rr.Code != http.StatusFound {
+				t.Errorf("expected sign-in to succeed, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if !tc.allowed && rr.Code != http.StatusForbidden {
+				t.Errorf("expected sign-in to be refused, got %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestOIDCRejectsBadTokens(t *testing.T) {
+	issuer := newMockIssuer(t)
+	s := newOIDCServer(t, issuer, OIDCConfig{})
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		edit func(g *mockGrant)
+	}{
+		{"forged signature", func(g *mockGrant) { g.signer = otherKey }},
+		{"wrong nonce", func(g *mockGrant) { g.claims["nonce"] = "replayed" }},
+		{"wrong audience", func(g *mockGrant) { g.claims["aud"] = "someone-else" }},
+		{"wrong issuer", func(g *mockGrant) { g.claims["iss"] = "https://evil.example" }},
+		{"expired", func(g *mockGrant) { g.claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"wrong verifier", func(g *mockGrant) { g.challenge = "not-the-challenge" }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := signIn(t, s, issuer, tc.edit)
+			if rr.Code != http.StatusBadGateway {
+				t.Errorf("expected sign-in to fail, got %d", rr.Code)
+			}
+			for _, cookie := range rr.Result().Cookies() {
+				if cookie.Name == sessionCookie {
+					t.Error("expected no session cookie")
+				}
+			}
+		})
+	}
+
+	// A callback that doesn't match the login it claims to finish
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", authCallbackPath+"?code=x&state=y", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a callback without a login to fail, got %d", rr.Code)
+	}
+}
+
+func TestOIDCFetchesDontHoldTheLock(t *testing.T) {
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	var issuer *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		json.NewEncoder(w).Encode(map[string]any{"keys": []any{}})
+	})
+	issuer = httptest.NewServer(mux)
+	defer issuer.Close()
+
+	p, err := newOIDCProvider(OIDCConfig{Issuer: issuer.URL, ClientID: "grombley"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	keyDone := make(chan struct{})
+	go func() {
+		defer close(keyDone)
+		p.key(context.Background(), "test")
+	}()
+	<-fetching
+
+	// With the key set still being fetched, the cached discovery has to be
+	// available straight away
+	discovered := make(chan error, 1)
+	go func() {
+		_, err := p.discover(context.Background())
+		discovered <- err
+	}()
+	select {
+	case err := <-discovered:
+		if err != nil {
+			t.Errorf("discover failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("discover waited for the key set fetch")
+	}
+
+	close(release)
+	<-keyDone
+}
+
+func TestVerifyJWTSignatureAlgorithms(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alg := range []string{"none", "HS256", "RS512"} {
+		if err := verifyJWTSignature(alg, &key.PublicKey, "a.b", nil); err == nil {
+			t.Errorf("expected %s to be refused", alg)
+		}
+	}
+}
+
+func TestSafeReturnPath(t *testing.T) {
+	testCases := map[string]string{
+		"":                   "/",
+		"/":                  "/",
+		"/i/abc.png":         "/i/abc.png",
+		"//evil.example/":    "/",
+		"/\\evil.example":    "/",
+		"https://evil.test/": "/",
+	}
+	for in, want := range testCases {
+		if got := safeReturnPath(in); got != want {
+			t.Errorf("safeReturnPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package grombley
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// PNG images and thumbnails are sent as WebP to clients that list image/webp
+// in their Accept header, when that comes out smaller. The WebP copy is kept
+// in the thumbnail cache next to the image's thumbnails, so it is made once
+// and goes away with the image. ?original=1 skips all of this. JPEGs are left
+// alone: our WebP encoder is lossless, which next to a lossy JPEG is almost
+// never smaller and would cost a decode and encode to find out.
+
+// noWebPVariant is what the cache holds when WebP wasn't any smaller, or the
+// image couldn't be transcoded, so we don't try again on every request
+var noWebPVariant = []byte{}
+
+// transcodable reports whether images of contentType can be sent as WebP
+func transcodable(contentType string) bool {
+	return contentType == "image/png"
+}
+
+// acceptsWebP reports whether an Accept header explicitly allows WebP.
+// Wildcards don't count: curl and friends send */* and expect the original.
+func acceptsWebP(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(mediaType), "image/webp") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) == "q" {
+				q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// wantsOriginal reports whether the request asked to skip transcoding
+func wantsOriginal(r *http.Request) bool {
+	original, _ := strconv.ParseBool(r.URL.Query().Get("original"))
+	return original
+}
+
+// negotiateWebP decides whether to send a WebP copy of something of
+// contentType, setting Vary since the answer depends on Accept
+func negotiateWebP(w http.ResponseWriter, r *http.Request, contentType string) bool {
+	if !transcodable(contentType) || wantsOriginal(r) {
+		return false
+	}
+	w.Header().Add("Vary", "Accept")
+	return acceptsWebP(r.Header.Get("Accept"))
+}
+
+// webpVariant returns a WebP copy of the image cached under name and key,
+// making it from source if needed. It returns false if WebP isn't smaller or
+// the image can't be transcoded.
+func (s *Server) webpVariant(name, key string, source func() ([]byte, error)) ([]byte, bool) {
+	if data, _, ok := s.thumbs.get(name, key); ok {
+		return data, len(data) > 0
+	}
+
+	src, err := source()
+	if err != nil {
+		return nil, false
+	}
+	var data []byte
+	if err := s.checkPixels(bytes.NewReader(src)); err == nil {
+		if data, err = transcodeWebP(src); err != nil {
+			fmt.Printf("Error transcoding %s to WebP: %v\n", name, err)
+		}
+	}
+
+	smaller := data != nil && len(data) < len(src)
+	if !smaller {
+		data = noWebPVariant
+	}
+	if err := s.thumbs.put(name, key, "image/webp", data); err != nil {
+		fmt.Printf("Error caching WebP copy of %s: %v\n", name, err)
+	} else if _, ok := s.images.LookupName(name); !ok {
+		// Deleted while we were busy; don't leave the copy behind
+		s.thumbs.invalidate(name)
+	}
+	return data, smaller
+}
+
+// transcodeWebP re-encodes a PNG as lossless WebP, turning it upright first
+// since the WebP carries no orientation tag
+func transcodeWebP(src []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	img = orientImage(img, getImageOrientation(src))
+
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
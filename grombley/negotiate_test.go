@@ -0,0 +1,211 @@
+package grombley
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// stripesPNG is a PNG that lossless WebP squeezes well
+func stripesPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 7), uint8(y * 3), uint8((x + y) % 5 * 40), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// noisePNG is a PNG of noise, which lossless WebP can't beat
+func noisePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func getWithAccept(s *Server, path, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAcceptsWebP(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"image/*", false},
+		{"image/webp", true},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", true},
+		{"image/png, IMAGE/WEBP ;q=0.5", true},
+		{"image/webp;q=0", false},
+		{"image/webp;q=bogus", false},
+		{"image/webpx", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsWebP(tt.accept); got != tt.want {
+			t.Errorf("acceptsWebP(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestServeWebPVariant(t *testing.T) {
+	s := newTestServer(t)
+	original := stripesPNG(t, 200, 200)
+	name := imageNameFromURL(uploadJSON(t, s, original).URL)
+
+	rr := getWithAccept(s, "/i/"+name, "image/webp,*/*")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("request failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/webp" {
+		t.Fatalf("expected Content-Type image/webp, got %s", ct)
+	}
+	if vary := rr.Header().Get("Vary"); vary != "Accept" {
+		t.Errorf("expected Vary: Accept, got %q", vary)
+	}
+	if etag := rr.Header().Get("ETag"); !strings.HasSuffix(etag, `-webp"`) {
+		t.Errorf("expected the WebP copy to have its own ETag, got %s", etag)
+	}
+	if rr.Body.Len() >= len(original) {
+		t.Errorf("WebP is %d bytes, original %d", rr.Body.Len(), len(original))
+	}
+	img, _, err := image.Decode(rr.Body)
+	if err != nil {
+		t.Fatalf("failed to decode WebP: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 200 {
+		t.Errorf("WebP is %dx%d, want 200x200", b.Dx(), b.Dy())
+	}
+	if _, _, ok := s.thumbs.get(name, "webp"); !ok {
+		t.Error("expected the WebP copy to be cached")
+	}
+
+	// Clients that don't ask for WebP, or ask for the original, get the PNG
+	for _, tc := range []struct{ path, accept string }{
+		{"/i/" + name, "*/*"},
+		{"/i/" + name + "?original=1", "image/webp"},
+	} {
+		rr = getWithAccept(s, tc.path, tc.accept)
+		if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("%s with Accept %q: expected image/png, got %s", tc.path, tc.accept, ct)
+		}
+		if !bytes.Equal(rr.Body.Bytes(), original) {
+			t.Errorf("%s with Accept %q: expected the original bytes", tc.path, tc.accept)
+		}
+	}
+
+	// Deleting the image drops its WebP copy too
+	if err := s.removeImage(name); err != nil {
+		t.Fatalf("removeImage failed: %v", err)
+	}
+	if _, _, ok := s.thumbs.get(name, "webp"); ok {
+		t.Error("expected the WebP copy to be removed with the image")
+	}
+}
+
+func TestWebPVariantNotSmaller(t *testing.T) {
+	s := newTestServer(t)
+	original := noisePNG(t, 64, 64)
+	name := imageNameFromURL(uploadJSON(t, s, original).URL)
+
+	for i := 0; i < 2; i++ {
+		rr := getWithAccept(s, "/i/"+name, "image/webp")
+		if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+			t.Fatalf("expected the PNG when WebP is bigger, got %s", ct)
+		}
+		if vary := rr.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("expected Vary: Accept, got %q", vary)
+		}
+	}
+	data, _, ok := s.thumbs.get(name, "webp")
+	if !ok || len(data) != 0 {
+		t.Error("expected the cache to remember that WebP isn't smaller")
+	}
+}
+
+func TestWebPSkipsJPEG(t *testing.T) {
+	s := newTestServer(t)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 64)), nil); err != nil {
+		t.Fatal(err)
+	}
+	name := imageNameFromURL(uploadJSON(t, s, buf.Bytes()).URL)
+
+	rr := getWithAccept(s, "/i/"+name, "image/webp")
+	if ct := rr.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("expected the JPEG as is, got %s", ct)
+	}
+	if vary := rr.Header().Get("Vary"); vary != "" {
+		t.Errorf("expected no Vary for a JPEG, got %q", vary)
+	}
+	if _, _, ok := s.thumbs.get(name, "webp"); ok {
+		t.Error("expected no WebP copy of a JPEG to be attempted")
+	}
+}
+
+func TestThumbnailWebPVariant(t *testing.T) {
+	s := newTestServer(t)
+	name := imageNameFromURL(uploadJSON(t, s, stripesPNG(t, 400, 400)).URL)
+
+	rr := getWithAccept(s, "/t/"+name, "image/webp")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("thumbnail failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/webp" {
+		t.Fatalf("expected Content-Type image/webp, got %s", ct)
+	}
+	img, _, err := image.Decode(rr.Body)
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Errorf("thumbnail is %dx%d, want 100x100", b.Dx(), b.Dy())
+	}
+
+	rr = getWithAccept(s, "/t/"+name, "")
+	if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected a PNG thumbnail without Accept, got %s", ct)
+	}
+	if vary := rr.Header().Get("Vary"); vary != "Accept" {
+		t.Errorf("expected Vary: Accept, got %q", vary)
+	}
+
+	// GIF thumbnails are left alone
+	name = imageNameFromURL(uploadJSON(t, s, testGIF(t)).URL)
+	rr = getWithAccept(s, "/t/"+name, "image/webp")
+	if ct := rr.Header().Get("Content-Type"); ct != "image/gif" {
+		t.Errorf("expected a GIF thumbnail, got %s", ct)
+	}
+	if vary := rr.Header().Get("Vary"); vary != "" {
+		t.Errorf("expected no Vary for a GIF, got %q", vary)
+	}
+}
@@ -0,0 +1,482 @@
+package grombley
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig puts the upload page and the upload handlers behind an OpenID
+// Connect login. It's enabled by setting Issuer.
+type OIDCConfig struct {
+	Issuer       string `toml:"issuer"`
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	// RedirectURL defaults to /auth/callback on the host the login started on
+	RedirectURL string `toml:"redirect_url"`
+	// Scopes are requested along with openid; email and profile by default
+	Scopes []string `toml:"scopes"`
+
+	// Only users with a verified email in AllowedDomains, or in one of
+	// AllowedGroups according to GroupsClaim, may sign in. With neither set
+	// anyone the issuer vouches for can.
+	AllowedDomains []string `toml:"allowed_domains"`
+	AllowedGroups  []string `toml:"allowed_groups"`
+	GroupsClaim    string   `toml:"groups_claim"`
+
+	// SessionSecret signs session cookies. Without one a random secret is
+	// made at startup, so sessions don't survive a restart.
+	SessionSecret string        `toml:"session_secret"`
+	SessionTTL    time.Duration `toml:"session_ttl"`
+}
+
+const (
+	defaultOIDCGroupsClaim = "groups"
+	defaultOIDCSessionTTL  = 24 * time.Hour
+
+	// oidcLeeway allows for clocks that disagree a little
+	oidcLeeway = time.Minute
+	// oidcKeyRefresh is the least time between fetches of the issuer's keys
+	oidcKeyRefresh = time.Minute
+)
+
+var defaultOIDCScopes = []string{"email", "profile"}
+
+// oidcProvider talks to the issuer: discovery, the token endpoint and the
+// keys ID tokens are signed with. Discovery happens on first use, so the
+// server starts even if the issuer is briefly unreachable.
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+// oidcDiscovery is the part of the issuer's metadata we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// idTokenClaims are the standard claims we check in an ID token
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   *bool    `json:"email_verified"`
+	Groups          []string `json:"-"`
+	// raw holds every claim, for the configurable groups claim
+	raw map[string]json.RawMessage
+}
+
+// audience is a JWT "aud", which may be a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func newOIDCProvider(config OIDCConfig) (*oidcProvider, error) {
+	if config.ClientID == "" {
+		return nil, errors.New("oidc needs a client_id")
+	}
+	issuer, err := url.Parse(config.Issuer)
+	if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && issuer.Scheme != "http") {
+		return nil, fmt.Errorf("invalid oidc issuer %q", config.Issuer)
+	}
+	if config.SessionTTL < 0 {
+		return nil, errors.New("oidc session_ttl must not be negative")
+	}
+	if config.SessionTTL == 0 {
+		config.SessionTTL = defaultOIDCSessionTTL
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = defaultOIDCGroupsClaim
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = defaultOIDCScopes
+	}
+
+	return &oidcProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}, nil
+}
+
+// getJSON fetches url and decodes a JSON response into v
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the issuer's metadata, fetching it the first time. The
+// lock isn't held while fetching, so a slow issuer doesn't hold up requests
+// that only need what's cached; concurrent first uses may each fetch, and the
+// first to finish wins.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	cached := p.discovery
+	p.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	var d oidcDiscovery
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &d); err != nil {
+		return nil, fmt.Errorf("error fetching oidc discovery: %w", err)
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc discovery is for issuer %q, not %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery is missing endpoints")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery == nil {
+		p.discovery = &d
+	}
+	return p.discovery, nil
+}
+
+// authCodeURL is where to send the browser to sign in
+func (p *oidcProvider) authCodeURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", redirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.config.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// exchange trades an authorization code for a verified ID token
+func (p *oidcProvider) exchange(ctx context.Context, redirectURL, code, verifier, nonce string) (*idTokenClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret == "" {
+		// Public clients identify themselves in the body
+		form.Set("client_id", p.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("error reading token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	return p.verifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// verifyIDToken checks an ID token's signature and claims
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed id token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature: %w", err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed id token claims: %w", err)
+	}
+	if err := decodeJWTPart(parts[1], &claims.raw); err != nil {
+		return nil, fmt.Errorf("malformed id token claims: %w", err)
+	}
+
+	now := p.now()
+	switch {
+	case claims.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("id token is from issuer %q", claims.Issuer)
+	case !slices.Contains(claims.Audience, p.config.ClientID):
+		return nil, errors.New("id token is not for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return nil, errors.New("id token was issued to another party")
+	case claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(oidcLeeway)):
+		return nil, errors.New("id token has expired")
+	case claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcLeeway)):
+		return nil, errors.New("id token was issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("id token nonce doesn't match")
+	case claims.Subject == "":
+		return nil, errors.New("id token has no subject")
+	}
+
+	if raw, ok := claims.raw[p.config.GroupsClaim]; ok {
+		var single string
+		if json.Unmarshal(raw, &claims.Groups) != nil && json.Unmarshal(raw, &single) == nil {
+			claims.Groups = []string{single}
+		}
+	}
+	return &claims, nil
+}
+
+// key returns the issuer's public key with ID kid, refetching the key set
+// if it's one we haven't seen, in case the issuer has rotated its keys
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	key, ok := p.lookupKey(kid)
+	fresh := !p.keysAt.IsZero() && p.now().Sub(p.keysAt) < oidcKeyRefresh
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if fresh {
+		return nil, fmt.Errorf("id token signed with unknown key %q", kid)
+	}
+
+	// Fetched without the lock, like discovery
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("error fetching oidc keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.keysAt = p.now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("id token signed with unknown key %q", kid)
+}
+
+// lookupKey finds a key by ID; a token without one may use the only key
+func (p *oidcProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if key, ok := p.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// jsonWebKey is an RSA or P-256 public key from a JWK set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC key is not on its curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifyJWTSignature checks a JWS signature made with RS256 or ES256, the
+// algorithms issuers actually use. Anything else, "none" included, fails.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("id token algorithm doesn't match its key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid id token signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("id token algorithm doesn't match its key")
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid id token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errors.New("invalid id token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported id token algorithm %q", alg)
+	}
+	return nil
+}
+
+// decodeJWTPart decodes one base64url JSON part of a JWT
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
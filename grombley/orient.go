@@ -0,0 +1,90 @@
+package grombley
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+)
+
+// normalizeJPEGQuality is used when re-encoding a JPEG to bake in its
+// orientation; high, since the original is replaced
+const normalizeJPEGQuality = 95
+
+// orientImage applies an EXIF orientation to img's pixels, returning an image
+// that looks right without the tag. Orientations 5-8 swap width and height.
+func orientImage(img image.Image, orientation uint16) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	src := toRGBA(img, img.Bounds())
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // needs turning clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // needs turning anticlockwise
+				dx, dy = y, w-1-x
+			}
+			si := y*src.Stride + x*4
+			di := dy*dst.Stride + dx*4
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// normalizeOrientation rewrites a JPEG or PNG so its pixels are the right
+// way up and it carries no EXIF at all. Images that are already upright are
+// only stripped, not re-encoded.
+func normalizeOrientation(data []byte) ([]byte, error) {
+	orientation := getImageOrientation(data)
+	if orientation < 2 || orientation > 8 {
+		return stripExif(data)
+	}
+	if !isJPEG(data) && !isPNG(data) {
+		// The only WebP encoder we have is lossless, which would balloon a
+		// lossy upload, so WebP keeps its orientation tag instead
+		return stripExifButKeepOrientation(data)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	img = orientImage(img, orientation)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: normalizeJPEGQuality})
+	case "png":
+		err = png.Encode(&buf, img)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encoding image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
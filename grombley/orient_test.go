@@ -0,0 +1,48 @@
+package grombley
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrientImage(t *testing.T) {
+	// A 3x2 image where every pixel is different:
+	//   0 1 2
+	//   3 4 5
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.SetNRGBA(i%3, i/3, color.NRGBA{uint8(i * 40), 0, 0, 255})
+	}
+
+	testCases := []struct {
+		orientation uint16
+		want        [][]int
+	}{
+		{1, [][]int{{0, 1, 2}, {3, 4, 5}}},
+		{2, [][]int{{2, 1, 0}, {5, 4, 3}}},
+		{3, [][]int{{5, 4, 3}, {2, 1, 0}}},
+		{4, [][]int{{3, 4, 5}, {0, 1, 2}}},
+		{5, [][]int{{0, 3}, {1, 4}, {2, 5}}},
+		{6, [][]int{{3, 0}, {4, 1}, {5, 2}}},
+		{7, [][]int{{5, 2}, {4, 1}, {3, 0}}},
+		{8, [][]int{{2, 5}, {1, 4}, {0, 3}}},
+	}
+
+	for _, tc := range testCases {
+		got := orientImage(src, tc.orientation)
+		b := got.Bounds()
+		if b.Dx() != len(tc.want[0]) || b.Dy() != len(tc.want) {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tc.orientation, b.Dx(), b.Dy(), len(tc.want[0]), len(tc.want))
+			continue
+		}
+		for y, row := range tc.want {
+			for x, want := range row {
+				r, _, _, _ := got.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				if int(r>>8) != want*40 {
+					t.Errorf("orientation %d: pixel %d,%d is %d, want %d", tc.orientation, x, y, r>>8/40, want)
+				}
+			}
+		}
+	}
+}
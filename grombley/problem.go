@@ -0,0 +1,93 @@
+package grombley
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Machine-readable error codes, sent as "code" in problem+json bodies
+const (
+	errCodeInvalidRequest    = "invalid_request"
+	errCodeInvalidURL        = "invalid_url"
+	errCodeURLNotAllowed     = "url_not_allowed"
+	errCodeUnknownHost       = "unknown_host"
+	errCodeTooManyRedirects  = "too_many_redirects"
+	errCodeRemoteStatus      = "remote_status"
+	errCodeFetchTimeout      = "fetch_timeout"
+	errCodeFetchFailed       = "fetch_failed"
+	errCodeTooLarge          = "too_large"
+	errCodeUnsupportedType   = "unsupported_type"
+	errCodeNotFound          = "not_found"
+	errCodeExpired           = "expired"
+	errCodeInvalidToken      = "invalid_token"
+	errCodeUnauthorized      = "unauthorized"
+	errCodeInsufficientScope = "insufficient_scope"
+	errCodeForbidden         = "forbidden"
+	errCodeLoginFailed       = "login_failed"
+	errCodeRateLimited       = "rate_limited"
+	errCodeQuotaExceeded     = "quota_exceeded"
+	errCodeMethodNotAllowed  = "method_not_allowed"
+	errCodeConflict          = "conflict"
+	errCodeInternal          = "internal_error"
+)
+
+// problem is an RFC 7807 problem details body
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+}
+
+// wantsJSON reports whether the client listed JSON in its Accept header
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			switch strings.TrimSpace(mediaType) {
+			case "application/json", "application/problem+json":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeError sends an error as problem+json to clients that asked for JSON
+// and as plain text to everyone else
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	if !wantsJSON(r) {
+		http.Error(w, detail, status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	})
+}
+
+// writeUploadError reports a failed storeImage
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errQuotaExceeded) {
+		setRetryAfter(w, quotaResetIn(time.Now()))
+	}
+	var uerr *uploadError
+	if errors.As(err, &uerr) {
+		writeError(w, r, uerr.Status, uerr.Code, uerr.Message)
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error processing file")
+}
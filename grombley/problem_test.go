@@ -0,0 +1,113 @@
+package grombley
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWantsJSON(t *testing.T) {
+	testCases := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", false},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"text/plain, application/json;q=0.9", true},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		if got := wantsJSON(req); got != tc.want {
+			t.Errorf("wantsJSON(%q) = %v, want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	s := newTestServer(t)
+
+	remote := httptest.NewServer(http.NotFoundHandler())
+	defer remote.Close()
+
+	testCases := []struct {
+		name   string
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{"unsupported upload", uploadRequest(t, []byte("not an image")), http.StatusBadRequest, errCodeUnsupportedType},
+		{"missing image", httptest.NewRequest("GET", "/i/nope.png", nil), http.StatusNotFound, errCodeNotFound},
+		{"delete missing image", httptest.NewRequest("DELETE", "/i/nope.png", nil), http.StatusNotFound, errCodeNotFound},
+		{"blocked url", httptest.NewRequest("POST", "/url", strings.NewReader(`{"url": "`+remote.URL+`"}`)), http.StatusForbidden, errCodeURLNotAllowed},
+		{"bad scheme", httptest.NewRequest("POST", "/url", strings.NewReader(`{"url": "file:///etc/passwd"}`)), http.StatusBadRequest, errCodeInvalidURL},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.Header.Set("Accept", "application/json")
+			rr := serve(s, tc.req)
+
+			if rr.Code != tc.status {
+				t.Errorf("Expected status %d, got %d", tc.status, rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Expected problem+json, got %q", ct)
+			}
+
+			var body problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Failed to decode problem: %v\n%s", err, rr.Body.String())
+			}
+			if body.Code != tc.code || body.Status != tc.status || body.Title != http.StatusText(tc.status) || body.Detail == "" {
+				t.Errorf("Unexpected problem body %+v", body)
+			}
+		})
+	}
+}
+
+func TestPlainTextErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := serve(s, uploadRequest(t, []byte("not an image")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rr.Code)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != "Unsupported file type" {
+		t.Errorf("Expected a plain text error without Accept: application/json, got %q", body)
+	}
+
+	rr = serve(s, httptest.NewRequest("GET", "/i/nope.png", nil))
+	if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "Fenton Not Found") {
+		t.Errorf("Expected the 404 page for browsers, got %d", rr.Code)
+	}
+}
+
+func TestUploadResponsesNegotiateJSON(t *testing.T) {
+	s := newTestServer(t)
+	accept := "application/json, text/plain;q=0.5"
+
+	req := uploadRequest(t, testPNG(t, 140))
+	req.Header.Set("Accept", accept)
+	rr := serve(s, req)
+	var result uploadResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil || result.URL == "" {
+		t.Errorf("Expected a JSON upload result for Accept %q, got %s", accept, rr.Body.String())
+	}
+
+	req = batchRequest(t, "file", [][]byte{testPNG(t, 141), testPNG(t, 142)})
+	req.Header.Set("Accept", accept)
+	rr = serve(s, req)
+	var results []map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Errorf("Expected a JSON batch result for Accept %q, got %s", accept, rr.Body.String())
+	}
+}
@@ -0,0 +1,215 @@
+package grombley
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Behind a reverse proxy every request comes from the proxy's address, over
+// whatever scheme and to whatever host the proxy uses to reach us. For
+// proxies listed in TrustedProxies we believe their forwarding headers.
+
+// trusted reports whether addr is one of the configured proxies
+func (s *Server) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr is the address the request's connection came from
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr.Unmap(), err == nil
+}
+
+// clientIP returns the address of the client behind a request. Walking the
+// for= elements of Forwarded, or X-Forwarded-For if there is none, from the
+// right, each trusted proxy vouches for the hop before it; the first address
+// no trusted proxy added is the client's. Anything further left is whatever
+// the client claimed and is ignored.
+func (s *Server) clientIP(r *http.Request) string {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !s.trusted(addr) {
+		return addr.String()
+	}
+
+	var hops []string
+	if elements := parseForwarded(r.Header.Values("Forwarded")); len(elements) > 0 {
+		for _, element := range elements {
+			hops = append(hops, element["for"])
+		}
+	} else {
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := forwardedFor(strings.TrimSpace(hops[i]))
+		if !ok {
+			// Garbage (or an obfuscated name) from here on can't be
+			// trusted; the last good hop is as far back as we can see
+			break
+		}
+		addr = hop
+		if !s.trusted(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// parsePublicURL checks public_url is just a scheme and host, since links
+// are built by adding our own paths to it
+func parsePublicURL(publicURL string) (*url.URL, error) {
+	if publicURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(publicURL, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || !validHost(u.Host) ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("public_url must be http:// or https:// and a host, with no path: %q", publicURL)
+	}
+	return u, nil
+}
+
+// requestOrigin returns the scheme and host clients used to reach us, for
+// building links back to the server. PublicURL wins if it's set; otherwise a
+// trusted proxy may say what it was asked for with Forwarded (RFC 7239) or
+// X-Forwarded-Proto and X-Forwarded-Host.
+func (s *Server) requestOrigin(r *http.Request) (scheme, host string) {
+	if s.publicURL != nil {
+		return s.publicURL.Scheme, s.publicURL.Host
+	}
+
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if addr, ok := remoteAddr(r); !ok || !s.trusted(addr) {
+		return scheme, host
+	}
+
+	if elements := parseForwarded(r.Header.Values("Forwarded")); len(elements) > 0 {
+		// Like X-Forwarded-For, each element was added by the proxy that
+		// received the request from its for=, so keep stepping left while
+		// that's another trusted proxy
+		for i := len(elements) - 1; i >= 0; i-- {
+			if proto, ok := forwardedProto(elements[i]["proto"]); ok {
+				scheme = proto
+			}
+			if validHost(elements[i]["host"]) {
+				host = elements[i]["host"]
+			}
+			addr, ok := forwardedFor(elements[i]["for"])
+			if !ok || !s.trusted(addr) {
+				break
+			}
+		}
+		return scheme, host
+	}
+
+	// These are normally set, not appended to, by the proxy in front of us;
+	// if there are several the last is the one it added
+	if proto, ok := forwardedProto(lastValue(r.Header.Values("X-Forwarded-Proto"))); ok {
+		scheme = proto
+	}
+	if forwardedHost := lastValue(r.Header.Values("X-Forwarded-Host")); validHost(forwardedHost) {
+		host = forwardedHost
+	}
+	return scheme, host
+}
+
+// lastValue returns the last of a header's comma-separated values
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	return strings.TrimSpace(last[strings.LastIndex(last, ",")+1:])
+}
+
+func forwardedProto(proto string) (string, bool) {
+	proto = strings.ToLower(proto)
+	return proto, proto == "http" || proto == "https"
+}
+
+// validHost reports whether host is a bare host[:port], so a forwarded value
+// can't smuggle a path or credentials into our links
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	u, err := url.Parse("http://" + host)
+	return err == nil && u.Host == host && u.User == nil && u.Path == "" &&
+		!u.ForceQuery && u.RawQuery == "" && u.Fragment == ""
+}
+
+// forwardedFor parses a Forwarded for= value, which may be an address, an
+// address and port (IPv6 in brackets), or an obfuscated name we can't use
+func forwardedFor(value string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	return addr.Unmap(), err == nil
+}
+
+// parseForwarded splits Forwarded headers into their elements, each a map
+// of lowercased parameter names to unquoted values. Commas and semicolons
+// inside quoted strings don't split anything.
+func parseForwarded(headers []string) []map[string]string {
+	var elements []map[string]string
+	for _, header := range headers {
+		for _, element := range splitQuoted(header, ',') {
+			params := make(map[string]string)
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+					value = unquoted
+				}
+				params[strings.ToLower(key)] = value
+			}
+			elements = append(elements, params)
+		}
+	}
+	return elements
+}
+
+// splitQuoted splits s at sep, except where sep is inside double quotes
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
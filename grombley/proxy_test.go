@@ -0,0 +1,152 @@
+package grombley
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.7"}})
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "198.51.100.1:1234", nil, "198.51.100.1"},
+		{"untrusted peer can't forward", "198.51.100.1:1234", []string{"203.0.113.9"}, "198.51.100.1"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"chain of proxies", "10.1.2.3:1234", []string{"203.0.113.9, 192.0.2.7, 10.9.9.9"}, "203.0.113.9"},
+		{"spoofed prefix ignored", "10.1.2.3:1234", []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"several headers", "10.1.2.3:1234", []string{"1.2.3.4", "203.0.113.9"}, "203.0.113.9"},
+		{"garbage stops the walk", "10.1.2.3:1234", []string{"203.0.113.9, junk, 10.9.9.9"}, "10.9.9.9"},
+		{"no header", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"mapped IPv4", "[::ffff:10.1.2.3]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := s.clientIP(req); got != tc.want {
+				t.Errorf("clientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := New(Config{UploadPath: t.TempDir(), TrustedProxies: []string{"not-an-address"}}); err == nil {
+		t.Error("expected a bad trusted_proxies entry to be refused")
+	}
+}
+
+func TestClientIPFromForwarded(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.7"}})
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"trusted proxy", "10.1.2.3:1234", []string{"for=203.0.113.9;proto=https"}, "203.0.113.9"},
+		{"untrusted peer can't forward", "198.51.100.1:1234", []string{"for=203.0.113.9"}, "198.51.100.1"},
+		{"chain of proxies", "10.1.2.3:1234", []string{`for=203.0.113.9, for="192.0.2.7:443", for=10.9.9.9`}, "203.0.113.9"},
+		{"spoofed prefix ignored", "10.1.2.3:1234", []string{"for=1.2.3.4", "for=203.0.113.9"}, "203.0.113.9"},
+		{"IPv6 with port", "10.1.2.3:1234", []string{`for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"obfuscated name stops the walk", "10.1.2.3:1234", []string{"for=203.0.113.9, for=_hidden, for=10.9.9.9"}, "10.9.9.9"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.forwarded {
+				req.Header.Add("Forwarded", value)
+			}
+			// Forwarded wins when a proxy sends both
+			req.Header.Set("X-Forwarded-For", "198.51.100.99")
+			if got := s.clientIP(req); got != tc.want {
+				t.Errorf("clientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{TrustedProxies: []string{"10.0.0.0/8"}})
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "198.51.100.1:1234", nil, "http://example.com"},
+		{"untrusted peer can't forward", "198.51.100.1:1234",
+			map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"}, "http://example.com"},
+		{"x-forwarded", "10.1.2.3:1234",
+			map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "img.example.com"}, "https://img.example.com"},
+		{"last x-forwarded value", "10.1.2.3:1234",
+			map[string]string{"X-Forwarded-Proto": "http, HTTPS"}, "https://example.com"},
+		{"forwarded", "10.1.2.3:1234",
+			map[string]string{"Forwarded": `for=203.0.113.9;proto=https;host="img.example.com:8443"`}, "https://img.example.com:8443"},
+		{"forwarded wins", "10.1.2.3:1234",
+			map[string]string{"Forwarded": "proto=https", "X-Forwarded-Host": "other.example"}, "https://example.com"},
+		{"forwarded chain", "10.1.2.3:1234",
+			map[string]string{"Forwarded": `for=203.0.113.9;proto=https;host=img.example.com, for="[::ffff:10.9.9.9]:80";proto=http;host=internal`},
+			"https://img.example.com"},
+		{"spoofed forwarded element ignored", "10.1.2.3:1234",
+			map[string]string{"Forwarded": `host=evil.example, for=203.0.113.9;proto=https;host=img.example.com`}, "https://img.example.com"},
+		{"quoted separators", "10.1.2.3:1234",
+			map[string]string{"Forwarded": `for="_a,b;c";proto=https`}, "https://example.com"},
+		{"bad values ignored", "10.1.2.3:1234",
+			map[string]string{"X-Forwarded-Proto": "gopher", "X-Forwarded-Host": "evil.example/path"}, "http://example.com"},
+		{"credentials ignored", "10.1.2.3:1234",
+			map[string]string{"X-Forwarded-Host": "user@evil.example"}, "http://example.com"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			if got := s.constructURL(req, ""); got != tc.want {
+				t.Errorf("constructURL = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{PublicURL: "https://img.example.com/", TrustedProxies: []string{"0.0.0.0/0"}})
+
+	req := uploadRequest(t, testPNG(t, 140))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Forwarded-Host", "other.example")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	var result uploadResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode upload response: %v", err)
+	}
+	for _, link := range []string{result.URL, result.DeleteURL} {
+		if !strings.HasPrefix(link, "https://img.example.com/") {
+			t.Errorf("expected links on the public URL, got %s", link)
+		}
+	}
+
+	for _, bad := range []string{"img.example.com", "ftp://img.example.com", "https://img.example.com/prefix", "https://u:p@img.example.com"} {
+		if _, err := New(Config{UploadPath: t.TempDir(), PublicURL: bad}); err == nil {
+			t.Errorf("expected public_url %q to be refused", bad)
+		}
+	}
+}
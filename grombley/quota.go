@@ -0,0 +1,111 @@
+package grombley
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Uploaders (API tokens and signed-in users) can be held to a number of
+// uploads and bytes stored per UTC day. Usage is counted from the index at
+// startup, so restarting doesn't hand out a fresh allowance. Duplicates of
+// stored images are free since they take no space.
+
+// errQuotaExceeded is returned when an upload would go over a daily quota
+var errQuotaExceeded = fmt.Errorf("daily upload quota exceeded")
+
+// quotaUsage is what one uploader has stored today
+type quotaUsage struct {
+	Uploads int64
+	Bytes   int64
+}
+
+// quotaTracker counts each uploader's usage for the current day
+type quotaTracker struct {
+	// limits returns an uploader's daily quotas; zero means unlimited
+	limits func(uploader string) (uploads, bytes int64)
+	now    func() time.Time
+
+	mu   sync.Mutex
+	day  time.Time
+	used map[string]quotaUsage
+}
+
+func newQuotaTracker(limits func(string) (int64, int64), images *ImageIndex) *quotaTracker {
+	q := &quotaTracker{limits: limits, now: time.Now, used: make(map[string]quotaUsage)}
+	q.day = startOfDay(q.now())
+	images.Range(func(name string, rec hashRecord) bool {
+		if rec.Uploader != "" && !rec.ModTime.Before(q.day) {
+			usage := q.used[rec.Uploader]
+			usage.Uploads++
+			usage.Bytes += rec.Size
+			q.used[rec.Uploader] = usage
+		}
+		return true
+	})
+	return q
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// rollover starts a new day's counts once midnight has passed
+func (q *quotaTracker) rollover() {
+	if today := startOfDay(q.now()); today.After(q.day) {
+		q.day = today
+		q.used = make(map[string]quotaUsage)
+	}
+}
+
+// reserve counts an upload of size bytes against uploader's quota, or
+// returns errQuotaExceeded if it doesn't fit. If the upload then isn't
+// stored after all, calling release gives the reservation back.
+func (q *quotaTracker) reserve(uploader string, size int64) (release func(), err error) {
+	release = func() {}
+	if uploader == "" {
+		return release, nil
+	}
+	maxUploads, maxBytes := q.limits(uploader)
+	if maxUploads == 0 && maxBytes == 0 {
+		return release, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+
+	usage := q.used[uploader]
+	if (maxUploads > 0 && usage.Uploads+1 > maxUploads) || (maxBytes > 0 && usage.Bytes+size > maxBytes) {
+		return release, errQuotaExceeded
+	}
+	usage.Uploads++
+	usage.Bytes += size
+	q.used[uploader] = usage
+
+	day := q.day
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		// After midnight there's nothing to give back
+		if usage, ok := q.used[uploader]; ok && q.day.Equal(day) {
+			usage.Uploads--
+			usage.Bytes -= size
+			q.used[uploader] = usage
+		}
+	}, nil
+}
+
+// check returns errQuotaExceeded if an upload of size bytes wouldn't fit in
+// uploader's quota, without counting it. Resumable uploads are checked this
+// way as they're created and as data arrives, and counted once stored.
+func (q *quotaTracker) check(uploader string, size int64) error {
+	release, err := q.reserve(uploader, size)
+	release()
+	return err
+}
+
+// quotaResetIn is how long after now quotas start afresh
+func quotaResetIn(now time.Time) time.Duration {
+	return startOfDay(now).Add(24 * time.Hour).Sub(now)
+}
@@ -0,0 +1,120 @@
+package grombley
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	now := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	limits := func(uploader string) (int64, int64) {
+		if uploader == "unlimited" {
+			return 0, 0
+		}
+		return 2, 100
+	}
+	q := newQuotaTracker(limits, newImageIndex(nil))
+	q.now = func() time.Time { return now }
+	q.day = startOfDay(now)
+
+	if _, err := q.reserve("pat", 60); err != nil {
+		t.Fatalf("first upload should fit: %v", err)
+	}
+	if _, err := q.reserve("pat", 50); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("expected going over the byte quota to fail, got %v", err)
+	}
+	release, err := q.reserve("pat", 40)
+	if err != nil {
+		t.Fatalf("second upload should fit: %v", err)
+	}
+	if _, err := q.reserve("pat", 0); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("expected a third upload to go over the count quota, got %v", err)
+	}
+
+	release()
+	if _, err := q.reserve("pat", 40); err != nil {
+		t.Errorf("expected a released reservation to free its share: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := q.reserve("unlimited", 1000); err != nil {
+			t.Fatalf("expected no quota for an unlimited uploader: %v", err)
+		}
+	}
+	if _, err := q.reserve("", 1000); err != nil {
+		t.Errorf("expected anonymous uploads not to be counted: %v", err)
+	}
+
+	// A reservation from yesterday doesn't come out of today's usage
+	release, _ = q.reserve("sam", 10)
+	now = now.Add(2 * time.Hour)
+	if _, err := q.reserve("pat", 60); err != nil {
+		t.Errorf("expected the quota to reset at midnight UTC: %v", err)
+	}
+	q.reserve("sam", 100)
+	release()
+	if _, err := q.reserve("sam", 1); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("expected yesterday's release to leave today's usage alone, got %v", err)
+	}
+
+	if got := quotaResetIn(time.Date(2026, 3, 2, 18, 30, 0, 0, time.UTC)); got != 5*time.Hour+30*time.Minute {
+		t.Errorf("quotaResetIn = %s, want 5h30m", got)
+	}
+}
+
+func TestQuotaCountsExistingUploads(t *testing.T) {
+	today := time.Now()
+	index := newImageIndex(nil)
+	index.load(map[string]hashRecord{
+		"a.png": {Hash: "a", Size: 70, ModTime: today, Uploader: "pat"},
+		"b.png": {Hash: "b", Size: 70, ModTime: today.Add(-48 * time.Hour), Uploader: "pat"},
+	})
+	q := newQuotaTracker(func(string) (int64, int64) { return 0, 100 }, index)
+
+	if _, err := q.reserve("pat", 40); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("expected today's stored upload to count, got %v", err)
+	}
+	if _, err := q.reserve("pat", 30); err != nil {
+		t.Errorf("expected older uploads not to count: %v", err)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	config := Config{
+		DailyUploads: 5,
+		APITokens: []APIToken{
+			{Name: "small", Hash: hashToken("small-secret"), Scopes: []string{scopeUpload}, DailyUploads: 1},
+		},
+	}
+	s := newTestServerWithConfig(t, config)
+
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		req := uploadRequest(t, data)
+		req.Header.Set("Authorization", "Bearer small-secret")
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := testPNG(t, 130)
+	if rr := upload(first); rr.Code != http.StatusOK {
+		t.Fatalf("expected the first upload to succeed, got %d", rr.Code)
+	}
+	// Duplicates take no space, so they're free
+	if rr := upload(first); rr.Code != http.StatusOK {
+		t.Errorf("expected a duplicate to be allowed, got %d", rr.Code)
+	}
+
+	rr := upload(testPNG(t, 131))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second upload to be over quota, got %d", rr.Code)
+	}
+	retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 24*60*60 {
+		t.Errorf("expected Retry-After until midnight, got %q", rr.Header().Get("Retry-After"))
+	}
+}
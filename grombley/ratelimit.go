@@ -0,0 +1,123 @@
+package grombley
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig is a token bucket: Rate requests a second on average, with
+// up to Burst at once. A zero Rate turns the limit off.
+type RateLimitConfig struct {
+	Rate float64 `toml:"rate"`
+	// Burst defaults to Rate, rounded up
+	Burst int `toml:"burst"`
+}
+
+// rateLimiter keeps a token bucket per client: an API token if the request
+// carries a valid one, otherwise its IP address
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil, which allows everything, for a zero Rate
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.Rate == 0 {
+		return nil
+	}
+	burst := float64(config.Burst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(config.Rate))
+	}
+	return &rateLimiter{
+		rate:    config.Rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from key's bucket, or says how long until there is one
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets clients whose buckets have refilled, since a new bucket
+// would be no different
+func (l *rateLimiter) sweep(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey identifies who a request counts against
+func (s *Server) rateLimitKey(r *http.Request) string {
+	if token, _, ok := s.bearerToken(r); ok {
+		return "token:" + token.Name
+	}
+	return "ip:" + s.clientIP(r)
+}
+
+// rateLimit refuses requests over limiter's rate with 429 Too Many Requests
+func (s *Server) rateLimit(limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := s.rateLimitKey(r)
+		if ok, wait := limiter.allow(key); !ok {
+			if s.config.Debug {
+				fmt.Printf("Rate limited %s on %s\n", key, r.URL.Path)
+			}
+			setRetryAfter(w, wait)
+			writeError(w, r, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests, slow down")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// setRetryAfter tells the client how many whole seconds to wait
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+}
@@ -0,0 +1,121 @@
+package grombley
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(RateLimitConfig{Rate: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d should fit in the burst", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatal("expected the fourth request to be limited")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms for a token, got %s", wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("expected other clients to have their own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("expected a token after waiting")
+	}
+
+	// Refilled buckets are forgotten; draining ones are kept
+	now = now.Add(time.Second)
+	l.sweep(now)
+	if _, ok := l.buckets["a"]; !ok {
+		t.Error("expected a's bucket, still refilling, to be kept")
+	}
+	l.sweep(now.Add(time.Minute))
+	if len(l.buckets) != 0 {
+		t.Errorf("expected refilled buckets to be swept, have %d", len(l.buckets))
+	}
+
+	if newRateLimiter(RateLimitConfig{}) != nil {
+		t.Error("expected a zero rate to turn limiting off")
+	}
+	if l := newRateLimiter(RateLimitConfig{Rate: 0.2}); l.burst != 1 {
+		t.Errorf("expected a default burst of 1 for slow rates, got %v", l.burst)
+	}
+}
+
+func TestRateLimitedUploads(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{UploadRate: RateLimitConfig{Rate: 0.01, Burst: 2}})
+
+	upload := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := uploadRequest(t, testPNG(t, 110))
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := upload("192.0.2.1:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("upload %d failed with %d", i, rr.Code)
+		}
+	}
+	rr := upload("192.0.2.1:5678")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+	if ra := rr.Header().Get("Retry-After"); ra != "100" {
+		t.Errorf("expected Retry-After: 100, got %q", ra)
+	}
+	if rr := upload("192.0.2.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("expected another client to be unaffected, got %d", rr.Code)
+	}
+
+	// Thumbnails aren't limited unless thumb_rate is set
+	name := imageNameFromURL(uploadJSON(t, newTestServer(t), testPNG(t, 120)).URL)
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name, nil))
+		if rr.Code == http.StatusTooManyRequests {
+			t.Fatal("expected thumbnails not to be rate limited")
+		}
+	}
+}
+
+func TestRateLimitPerToken(t *testing.T) {
+	config := Config{
+		UploadRate: RateLimitConfig{Rate: 0.01, Burst: 1},
+		APITokens: []APIToken{
+			{Name: "a", Hash: hashToken("token-a"), Scopes: []string{scopeUpload}},
+			{Name: "b", Hash: hashToken("token-b"), Scopes: []string{scopeUpload}},
+		},
+	}
+	s := newTestServerWithConfig(t, config)
+
+	upload := func(token string, shade uint8) int {
+		req := uploadRequest(t, testPNG(t, shade))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Both come from the same address, but each token has its own bucket
+	if code := upload("token-a", 1); code != http.StatusOK {
+		t.Fatalf("expected token a's first upload to succeed, got %d", code)
+	}
+	if code := upload("token-a", 2); code != http.StatusTooManyRequests {
+		t.Errorf("expected token a to be limited, got %d", code)
+	}
+	if code := upload("token-b", 3); code != http.StatusOK {
+		t.Errorf("expected token b to have its own bucket, got %d", code)
+	}
+}
@@ -0,0 +1,83 @@
+package grombley
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxNameHintLength caps how much of a filename hint ends up in the stored name
+const maxNameHintLength = 32
+
+// isRawUpload reports whether an /upload request carries the file as its
+// whole body rather than as a multipart form. curl's --data-binary sends
+// application/x-www-form-urlencoded, so anything that isn't multipart counts.
+func isRawUpload(r *http.Request) bool {
+	if r.Method == http.MethodPut {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == http.MethodPost && mediaType != "multipart/form-data"
+}
+
+// sanitizeNameHint reduces a client-supplied filename to a safe stem: the
+// extension is dropped (we detect the real type ourselves) and anything other
+// than letters, digits, '-' and '_' becomes '-'
+func sanitizeNameHint(hint string) string {
+	hint = path.Base(strings.ReplaceAll(hint, "\\", "/"))
+	hint = strings.TrimSuffix(hint, path.Ext(hint))
+
+	var b strings.Builder
+	for _, c := range hint {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			b.WriteRune(c)
+		default:
+			b.WriteRune('-')
+		}
+		if b.Len() >= maxNameHintLength {
+			break
+		}
+	}
+
+	stem := strings.Trim(b.String(), "-")
+	for strings.Contains(stem, "--") {
+		stem = strings.ReplaceAll(stem, "--", "-")
+	}
+	return stem
+}
+
+// Raw upload: the request body is the image. PUT or POST to /upload, or to
+// /upload/<filename> to give a name hint (also accepted as ?filename=).
+func (s *Server) rawUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	hint := strings.TrimPrefix(r.URL.Path, "/upload")
+	hint = strings.TrimPrefix(hint, "/")
+	if hint == "" {
+		hint = r.URL.Query().Get("filename")
+	}
+
+	ttl, err := s.requestTTL(r, r.URL.Query().Get("expires"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if r.ContentLength == 0 {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Empty request body")
+		return
+	}
+	if r.ContentLength > s.config.MaxUploadBytes {
+		writeError(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, s.tooLargeMessage())
+		return
+	}
+	s.limitBody(w, r)
+
+	s.writeFileAndReturnURL(w, r, r.Body, uploadOptions{TTL: ttl, NameHint: hint})
+}
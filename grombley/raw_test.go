@@ -0,0 +1,109 @@
+package grombley
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeNameHint(t *testing.T) {
+	testCases := []struct {
+		hint string
+		want string
+	}{
+		{"", ""},
+		{"shot.png", "shot"},
+		{"login page (1).png", "login-page-1"},
+		{"../../etc/passwd", "passwd"},
+		{"C:\\Users\\me\\bug_report.jpeg", "bug_report"},
+		{".hidden", ""},
+		{"ünïcødé.gif", "n-c-d"},
+		{strings.Repeat("a", 100) + ".png", strings.Repeat("a", maxNameHintLength)},
+	}
+
+	for _, tc := range testCases {
+		if got := sanitizeNameHint(tc.hint); got != tc.want {
+			t.Errorf("sanitizeNameHint(%q) = %q, want %q", tc.hint, got, tc.want)
+		}
+	}
+}
+
+func TestRawUpload(t *testing.T) {
+	s := newTestServer(t)
+	data := testPNG(t, 140)
+
+	req := httptest.NewRequest("PUT", "/upload/login%20page.jpg", bytes.NewReader(data))
+	req.Header.Set("Accept", "application/json")
+	rr := serve(s, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var result uploadResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	name := imageNameFromURL(result.URL)
+	if !strings.HasPrefix(name, "login-page-") || !strings.HasSuffix(name, ".png") {
+		t.Errorf("expected name from hint with detected extension, got %s", name)
+	}
+	if err := validateImageName(name, s.config.UploadPath); err != nil {
+		t.Errorf("hinted name %s doesn't validate: %v", name, err)
+	}
+	if result.DeleteToken == "" {
+		t.Errorf("expected a delete token for a raw upload")
+	}
+
+	rr = serve(s, httptest.NewRequest("GET", "/i/"+name, nil))
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("expected stored image to be served back, got %d", rr.Code)
+	}
+
+	// What curl --data-binary sends; the same content dedups
+	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = serve(s, req)
+	if got := strings.TrimSpace(rr.Body.String()); got != result.URL {
+		t.Errorf("expected raw POST to dedup to %s, got %q", result.URL, got)
+	}
+}
+
+func TestRawUploadExpiryAndHintQuery(t *testing.T) {
+	s := newTestServer(t)
+
+	req := httptest.NewRequest("PUT", "/upload?filename=ci-run.png&expires=1h", bytes.NewReader(testPNG(t, 150)))
+	req.Header.Set("Accept", "application/json")
+	rr := serve(s, req)
+
+	var result uploadResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rr.Body.String(), err)
+	}
+	if !strings.HasPrefix(imageNameFromURL(result.URL), "ci-run-") {
+		t.Errorf("expected name hint from query, got %s", result.URL)
+	}
+	if result.Expires == "" {
+		t.Errorf("expected expiry from query to apply")
+	}
+}
+
+func TestRawUploadErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := serve(s, httptest.NewRequest("PUT", "/upload/empty.png", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for empty body, got %d", rr.Code)
+	}
+
+	rr = serve(s, httptest.NewRequest("PUT", "/upload/notes.png", strings.NewReader("plain text")))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Unsupported file type") {
+		t.Errorf("expected unsupported type, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = serve(s, httptest.NewRequest("GET", "/upload/whatever.png", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rr.Code)
+	}
+}
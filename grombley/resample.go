@@ -0,0 +1,209 @@
+package grombley
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Thumbnails are downscaled with a Lanczos-3 filter widened by the scale
+// factor, so every source pixel contributes and fine detail like text comes
+// out smooth instead of aliased. The filter runs in two separable passes over
+// premultiplied RGBA, which keeps transparent edges from picking up a dark
+// fringe. Decoded images are first copied into an *image.RGBA with loops
+// specialised for the types the standard decoders return, avoiding a pair of
+// interface calls per pixel.
+
+// lanczosRadius is the number of lobes of the Lanczos filter
+const lanczosRadius = 3
+
+// resizeImage scales the src region of img to newW by newH
+func resizeImage(img image.Image, src image.Rectangle, newW, newH int) image.Image {
+	pixels := toRGBA(img, src)
+	return resample(pixels, newW, newH)
+}
+
+// toRGBA copies the r region of img into a new premultiplied RGBA image with
+// its origin at 0,0
+func toRGBA(img image.Image, r image.Rectangle) *image.RGBA {
+	r = r.Intersect(img.Bounds())
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+
+	switch src := img.(type) {
+	case *image.YCbCr:
+		for y := 0; y < r.Dy(); y++ {
+			row := dst.Pix[y*dst.Stride:]
+			for x := 0; x < r.Dx(); x++ {
+				yi := src.YOffset(r.Min.X+x, r.Min.Y+y)
+				ci := src.COffset(r.Min.X+x, r.Min.Y+y)
+				cr, cg, cb := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				row[x*4+0], row[x*4+1], row[x*4+2], row[x*4+3] = cr, cg, cb, 0xff
+			}
+		}
+
+	case *image.NRGBA:
+		for y := 0; y < r.Dy(); y++ {
+			row := dst.Pix[y*dst.Stride:]
+			in := src.Pix[src.PixOffset(r.Min.X, r.Min.Y+y):]
+			for x := 0; x < r.Dx(); x++ {
+				a := uint32(in[x*4+3])
+				row[x*4+0] = uint8(uint32(in[x*4+0]) * a / 0xff)
+				row[x*4+1] = uint8(uint32(in[x*4+1]) * a / 0xff)
+				row[x*4+2] = uint8(uint32(in[x*4+2]) * a / 0xff)
+				row[x*4+3] = uint8(a)
+			}
+		}
+
+	case *image.Paletted:
+		// Convert the palette once rather than every pixel
+		lut := make([][4]uint8, 256)
+		for i, c := range src.Palette {
+			pr, pg, pb, pa := c.RGBA()
+			lut[i] = [4]uint8{uint8(pr >> 8), uint8(pg >> 8), uint8(pb >> 8), uint8(pa >> 8)}
+		}
+		for y := 0; y < r.Dy(); y++ {
+			row := dst.Pix[y*dst.Stride:]
+			in := src.Pix[src.PixOffset(r.Min.X, r.Min.Y+y):]
+			for x := 0; x < r.Dx(); x++ {
+				copy(row[x*4:x*4+4], lut[in[x]][:])
+			}
+		}
+
+	case *image.Gray:
+		for y := 0; y < r.Dy(); y++ {
+			row := dst.Pix[y*dst.Stride:]
+			in := src.Pix[src.PixOffset(r.Min.X, r.Min.Y+y):]
+			for x := 0; x < r.Dx(); x++ {
+				v := in[x]
+				row[x*4+0], row[x*4+1], row[x*4+2], row[x*4+3] = v, v, v, 0xff
+			}
+		}
+
+	default:
+		// draw has fast paths of its own for RGBA and friends and falls back
+		// to At for everything else
+		draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	}
+	return dst
+}
+
+// filterWeights holds, for each output pixel along one axis, the first
+// source pixel it reads and the weights of it and the ones after it
+type filterWeights struct {
+	start   []int
+	weights [][]float32
+}
+
+// lanczos is the Lanczos kernel sinc(x)·sinc(x/a)
+func lanczos(x float64) float64 {
+	x = math.Abs(x)
+	if x == 0 {
+		return 1
+	}
+	if x >= lanczosRadius {
+		return 0
+	}
+	px := math.Pi * x
+	return lanczosRadius * math.Sin(px) * math.Sin(px/lanczosRadius) / (px * px)
+}
+
+// newFilterWeights works out the filter taps for scaling srcLen pixels to dstLen
+func newFilterWeights(srcLen, dstLen int) filterWeights {
+	scale := float64(srcLen) / float64(dstLen)
+	// Downscaling widens the filter so it covers every source pixel
+	filterScale := math.Max(scale, 1)
+	support := lanczosRadius * filterScale
+
+	fw := filterWeights{
+		start:   make([]int, dstLen),
+		weights: make([][]float32, dstLen),
+	}
+	for i := 0; i < dstLen; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		lo := max(0, int(math.Ceil(center-support)))
+		hi := min(srcLen-1, int(math.Floor(center+support)))
+
+		weights := make([]float32, hi-lo+1)
+		var sum float64
+		for j := lo; j <= hi; j++ {
+			w := lanczos((float64(j) - center) / filterScale)
+			weights[j-lo] = float32(w)
+			sum += w
+		}
+		if sum != 0 {
+			for k := range weights {
+				weights[k] = float32(float64(weights[k]) / sum)
+			}
+		}
+		fw.start[i] = lo
+		fw.weights[i] = weights
+	}
+	return fw
+}
+
+// resample scales src, whose origin is 0,0, to newW by newH
+func resample(src *image.RGBA, newW, newH int) *image.RGBA {
+	srcW, srcH := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, newW, newH))
+	if srcW == 0 || srcH == 0 || newW == 0 || newH == 0 {
+		return dst
+	}
+
+	// Horizontal pass: srcH rows of newW pixels, kept as floats
+	horiz := newFilterWeights(srcW, newW)
+	tmp := make([]float32, newW*srcH*4)
+	for y := 0; y < srcH; y++ {
+		in := src.Pix[y*src.Stride:]
+		out := tmp[y*newW*4:]
+		for x := 0; x < newW; x++ {
+			var r, g, b, a float32
+			pi := horiz.start[x] * 4
+			for _, w := range horiz.weights[x] {
+				r += w * float32(in[pi+0])
+				g += w * float32(in[pi+1])
+				b += w * float32(in[pi+2])
+				a += w * float32(in[pi+3])
+				pi += 4
+			}
+			out[x*4+0], out[x*4+1], out[x*4+2], out[x*4+3] = r, g, b, a
+		}
+	}
+
+	// Vertical pass into the result
+	vert := newFilterWeights(srcH, newH)
+	rowLen := newW * 4
+	for y := 0; y < newH; y++ {
+		out := dst.Pix[y*dst.Stride:]
+		start := vert.start[y] * rowLen
+		for x := 0; x < newW; x++ {
+			var r, g, b, a float32
+			ti := start + x*4
+			for _, w := range vert.weights[y] {
+				r += w * tmp[ti+0]
+				g += w * tmp[ti+1]
+				b += w * tmp[ti+2]
+				a += w * tmp[ti+3]
+				ti += rowLen
+			}
+			// Lanczos rings a little around hard edges; keep the result a
+			// valid premultiplied color
+			ca := clampUint8(a)
+			out[x*4+0] = min(clampUint8(r), ca)
+			out[x*4+1] = min(clampUint8(g), ca)
+			out[x*4+2] = min(clampUint8(b), ca)
+			out[x*4+3] = ca
+		}
+	}
+	return dst
+}
+
+func clampUint8(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,223 @@
+package grombley
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden thumbnails in testdata")
+
+// checkerboard returns an image of alternating black and white pixels, the
+// worst case for point sampling
+func checkerboard(size int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestResampleAveragesDetail(t *testing.T) {
+	img := resizeImage(checkerboard(64), image.Rect(0, 0, 64, 64), 16, 16).(*image.RGBA)
+
+	// Every output pixel should be close to mid-grey, not black or white
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			c := img.RGBAAt(x, y)
+			if c.R < 120 || c.R > 135 || c.A != 255 {
+				t.Fatalf("pixel %d,%d is %v, want mid-grey", x, y, c)
+			}
+		}
+	}
+}
+
+func TestResampleKeepsTransparentEdgesClean(t *testing.T) {
+	// Opaque red on the left, fully transparent black on the right
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+
+	out := resizeImage(img, img.Bounds(), 16, 16)
+	for x := 0; x < 16; x++ {
+		c := color.NRGBAModel.Convert(out.At(x, 8)).(color.NRGBA)
+		if c.A > 0 && (c.R < 250 || c.G > 5 || c.B > 5) {
+			t.Errorf("pixel %d,8 is %v; transparent pixels shouldn't darken the red", x, c)
+		}
+	}
+}
+
+func TestToRGBAMatchesDraw(t *testing.T) {
+	rect := image.Rect(0, 0, 37, 23)
+	src := image.NewNRGBA(rect)
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			src.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 11), uint8(x * y), uint8(255 - x*3)})
+		}
+	}
+
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	paletted := image.NewPaletted(rect, color.Palette{
+		color.NRGBA{0, 0, 0, 0}, color.NRGBA{200, 100, 50, 128}, color.NRGBA{10, 250, 90, 255},
+	})
+	gray := image.NewGray(rect)
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			c := src.NRGBAAt(x, y)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+			ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+			ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+			paletted.SetColorIndex(x, y, uint8((x+y)%3))
+			gray.SetGray(x, y, color.Gray{Y: c.G})
+		}
+	}
+
+	crop := image.Rect(3, 5, 30, 20)
+	for name, img := range map[string]image.Image{
+		"NRGBA":    src,
+		"YCbCr":    ycbcr,
+		"Paletted": paletted,
+		"Gray":     gray,
+	} {
+		got := toRGBA(img, crop)
+		want := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+		draw.Draw(want, want.Bounds(), img, crop.Min, draw.Src)
+
+		for i := range want.Pix {
+			if d := int(got.Pix[i]) - int(want.Pix[i]); d < -1 || d > 1 {
+				t.Errorf("%s: byte %d is %d, want %d", name, i, got.Pix[i], want.Pix[i])
+				break
+			}
+		}
+	}
+}
+
+// TestResizeGolden compares thumbnails against known-good copies in testdata.
+// Run with -update after an intentional change to the filter.
+func TestResizeGolden(t *testing.T) {
+	testCases := []struct {
+		source, golden string
+		spec           thumbSpec
+	}{
+		{"../tests/images/test.jpg", "test-320x240.png", thumbSpec{thumbSize: thumbSize{320, 240}, Fit: fitContain}},
+		{"../tests/images/slimer.png", "slimer-160x160.png", thumbSpec{thumbSize: thumbSize{160, 160}, Fit: fitCover}},
+	}
+
+	for _, tc := range testCases {
+		file, err := os.Open(tc.source)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", tc.source, err)
+		}
+		img, _, err := fitImage(file, tc.spec)
+		file.Close()
+		if err != nil {
+			t.Fatalf("fitImage(%s) failed: %v", tc.source, err)
+		}
+
+		goldenPath := filepath.Join("testdata", tc.golden)
+		if *updateGolden {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				t.Fatalf("failed to encode %s: %v", tc.golden, err)
+			}
+			if err := os.WriteFile(goldenPath, buf.Bytes(), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", goldenPath, err)
+			}
+			continue
+		}
+
+		goldenFile, err := os.Open(goldenPath)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", goldenPath, err)
+		}
+		golden, err := png.Decode(goldenFile)
+		goldenFile.Close()
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", goldenPath, err)
+		}
+
+		if img.Bounds() != golden.Bounds() {
+			t.Errorf("%s: got bounds %v, golden has %v", tc.golden, img.Bounds(), golden.Bounds())
+			continue
+		}
+		// Allow for float rounding differences between platforms
+		got, want := toRGBA(img, img.Bounds()), toRGBA(golden, golden.Bounds())
+		for i := range want.Pix {
+			if d := int(got.Pix[i]) - int(want.Pix[i]); d < -2 || d > 2 {
+				t.Errorf("%s: pixel %d differs from golden: %d vs %d", tc.golden, i/4, got.Pix[i], want.Pix[i])
+				break
+			}
+		}
+	}
+}
+
+// genericImage hides an image's concrete type, forcing the At-per-pixel path
+type genericImage struct {
+	image.Image
+}
+
+func BenchmarkResizeImage(b *testing.B) {
+	file, err := os.Open("../tests/images/test.jpg")
+	if err != nil {
+		b.Fatalf("failed to open test image: %v", err)
+	}
+	defer file.Close()
+	src, _, err := image.Decode(file)
+	if err != nil {
+		b.Fatalf("failed to decode test image: %v", err)
+	}
+	nrgba := image.NewNRGBA(src.Bounds())
+	draw.Draw(nrgba, nrgba.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	for _, bc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"YCbCr", src},
+		{"NRGBA", nrgba},
+		{"generic", genericImage{src}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				resizeImage(bc.img, bc.img.Bounds(), 568, 426)
+			}
+		})
+	}
+}
+
+func BenchmarkToRGBA(b *testing.B) {
+	file, err := os.Open("../tests/images/test.jpg")
+	if err != nil {
+		b.Fatalf("failed to open test image: %v", err)
+	}
+	defer file.Close()
+	src, _, err := image.Decode(file)
+	if err != nil {
+		b.Fatalf("failed to decode test image: %v", err)
+	}
+
+	b.Run("YCbCr", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			toRGBA(src, src.Bounds())
+		}
+	})
+	b.Run("generic", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			toRGBA(genericImage{src}, src.Bounds())
+		}
+	})
+}
@@ -0,0 +1,463 @@
+package grombley
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config points the s3 storage backend at a bucket on AWS or any
+// S3-compatible service such as MinIO
+type S3Config struct {
+	// Endpoint defaults to AWS for Region, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint string `toml:"endpoint"`
+	Region   string `toml:"region"`
+	Bucket   string `toml:"bucket"`
+	// Prefix is prepended to every object key, e.g. "images/"
+	Prefix string `toml:"prefix"`
+	// Credentials fall back to AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	// PathStyle puts the bucket in the path rather than the hostname, which
+	// most self-hosted services need
+	PathStyle bool `toml:"path_style"`
+}
+
+const defaultS3Region = "us-east-1"
+
+// emptyPayloadHash is the SHA-256 of an empty body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Storage keeps images as objects in a bucket. Requests are signed with
+// AWS Signature Version 4.
+type s3Storage struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newS3Storage(config S3Config) (*s3Storage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("s3 storage needs a bucket")
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	if config.AccessKey == "" {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if config.SecretKey == "" {
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, errors.New("s3 storage needs an access key and secret key")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", config.Endpoint)
+	}
+
+	return &s3Storage{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+// objectURL returns the URL for key (already including the prefix), or for
+// the bucket itself if key is empty
+func (s *s3Storage) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.config.PathStyle {
+		objectPath = "/" + s.config.Bucket + objectPath
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = path.Join(strings.TrimSuffix(s.endpoint.Path, "/"), objectPath)
+	if key == "" && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+func (s *s3Storage) do(ctx context.Context, method string, u *url.URL, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, payloadHash, s.now())
+
+	return s.client.Do(req)
+}
+
+// s3Error turns a failed response into an error, mapping 404 to fs.ErrNotExist
+func s3Error(op string, name string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	var s3err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &s3err) == nil && s3err.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s", op, name, s3err.Code, s3err.Message)
+	}
+	return fmt.Errorf("s3 %s %s: %s", op, name, resp.Status)
+}
+
+// Object metadata headers holding a fileMeta
+const (
+	s3MetaHash        = "X-Amz-Meta-Grombley-Hash"
+	s3MetaDeleteToken = "X-Amz-Meta-Grombley-Delete-Token"
+	s3MetaExpires     = "X-Amz-Meta-Grombley-Expires"
+	s3MetaUploader    = "X-Amz-Meta-Grombley-Uploader"
+)
+
+// setS3Meta adds meta to header as object metadata. Metadata has to be
+// ASCII, so the uploader, which may be anyone's name, is escaped.
+func setS3Meta(header http.Header, name string, meta fileMeta) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set(s3MetaHash, meta.Hash)
+	if meta.DeleteToken != "" {
+		header.Set(s3MetaDeleteToken, meta.DeleteToken)
+	}
+	if !meta.Expires.IsZero() {
+		header.Set(s3MetaExpires, meta.Expires.UTC().Format(time.RFC3339Nano))
+	}
+	if meta.Uploader != "" {
+		header.Set(s3MetaUploader, url.QueryEscape(meta.Uploader))
+	}
+}
+
+// s3Meta reads back what setS3Meta stored, or returns nil for an object we
+// didn't upload
+func s3Meta(header http.Header) *fileMeta {
+	hash := header.Get(s3MetaHash)
+	if hash == "" {
+		return nil
+	}
+	meta := &fileMeta{Hash: hash, DeleteToken: header.Get(s3MetaDeleteToken)}
+	if expires := header.Get(s3MetaExpires); expires != "" {
+		meta.Expires, _ = time.Parse(time.RFC3339Nano, expires)
+	}
+	meta.Uploader, _ = url.QueryUnescape(header.Get(s3MetaUploader))
+	return meta
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	// The payload hash is part of the signature, so the body is read up front
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	setS3Meta(header, name, meta)
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(s.config.Prefix+name), data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", name, resp)
+	}
+	return nil
+}
+
+// Get downloads the whole object; images are small enough that this is
+// simpler than seeking with range requests
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(s.config.Prefix+name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("get", name, resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (fileInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(s.config.Prefix+name), nil, nil)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fileInfo{}, s3Error("stat", name, resp)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return fileInfo{
+		Name:    name,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+		Hash:    etagHash(resp.Header.Get("ETag")),
+		Meta:    s3Meta(resp.Header),
+	}, nil
+}
+
+// SetMeta copies the object onto itself with new metadata, the only way S3
+// has of changing it
+func (s *s3Storage) SetMeta(ctx context.Context, name string, meta fileMeta) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", uriEncode("/"+s.config.Bucket+"/"+s.config.Prefix+name, false))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	setS3Meta(header, name, meta)
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(s.config.Prefix+name), nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("copy", name, resp)
+	}
+
+	// A copy can fail after S3 has already answered 200
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	var s3err struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &s3err) == nil && s3err.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 copy %s: %s: %s", name, s3err.Code, s3err.Message)
+	}
+	return nil
+}
+
+// Delete succeeds whether or not the object existed, as S3 does
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(s.config.Prefix+name), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("delete", name, resp)
+	}
+	return nil
+}
+
+// listBucketResult is the part of a ListObjectsV2 response we use
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+// List returns the objects directly under the prefix, skipping anything
+// that looks like a directory or a dotfile. Listings give times to the
+// millisecond but Last-Modified only has seconds, so List drops the rest for
+// the two to agree. Listings don't include metadata.
+func (s *s3Storage) List(ctx context.Context) ([]fileInfo, error) {
+	var files []fileInfo
+	token := ""
+	for {
+		u := s.objectURL("")
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.config.Prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(query)
+
+		resp, err := s.do(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error("list", s.config.Bucket, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding s3 listing: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.config.Prefix)
+			if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+				continue
+			}
+			files = append(files, fileInfo{
+				Name:    name,
+				Size:    obj.Size,
+				ModTime: obj.LastModified.Truncate(time.Second),
+				Hash:    etagHash(obj.ETag),
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// etagHash returns the MD5 an ETag carries, if it does. Multipart uploads
+// and encrypted objects have ETags that aren't plain MD5s.
+func etagHash(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+	return strings.ToLower(etag)
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+// sign adds AWS Signature Version 4 headers to req, signing the host and
+// every x-amz- header, which includes the payload hash, date and metadata
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted and escaped the way SigV4 expects
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and '/'
+// unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,477 @@
+// Package grombley is a self-hosted image hosting service. A Server can run
+// standalone or be mounted inside another application via its Handler.
+package grombley
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Config controls where a Server listens, stores and serves images
+type Config struct {
+	Bind       string `toml:"bind"`
+	Debug      bool   `toml:"debug"`
+	ServePath  string `toml:"serve_path"`
+	UploadPath string `toml:"upload_path"`
+
+	// DefaultTTL applies to uploads that don't ask for an expiry; zero keeps
+	// them forever. Uploads can opt out of it with an expiry of "never".
+	// MaxTTL caps what uploads may ask for, "never" included; zero means no
+	// cap.
+	DefaultTTL time.Duration `toml:"default_ttl"`
+	MaxTTL     time.Duration `toml:"max_ttl"`
+
+	// MaxUploadBytes caps the size of an upload request. MaxPixels caps an
+	// image's width × height, so a small file can't decode into gigabytes.
+	MaxUploadBytes int64 `toml:"max_upload_bytes"`
+	MaxPixels      int64 `toml:"max_pixels"`
+
+	// URL uploads may only reach public addresses; FetchAllow lists CIDRs
+	// (or single addresses) that are reachable anyway. FetchMaxRedirects is
+	// a pointer so that 0, following no redirects, differs from unset.
+	FetchAllow          []string      `toml:"fetch_allow"`
+	FetchConnectTimeout time.Duration `toml:"fetch_connect_timeout"`
+	FetchTimeout        time.Duration `toml:"fetch_timeout"`
+	FetchMaxBytes       int64         `toml:"fetch_max_bytes"`
+	FetchMaxRedirects   *int          `toml:"fetch_max_redirects"`
+
+	// Storage is where images are kept: "fs" (UploadPath, the default) or
+	// "s3". UploadPath still holds the hash index and resumable uploads.
+	Storage string   `toml:"storage"`
+	S3      S3Config `toml:"s3"`
+
+	// Generated thumbnails are cached in ThumbCachePath (UploadPath/.thumbs
+	// by default), evicting the least recently used past ThumbCacheBytes
+	ThumbCachePath  string `toml:"thumb_cache_path"`
+	ThumbCacheBytes int64  `toml:"thumb_cache_bytes"`
+
+	// ThumbSizes lists the "WIDTHxHEIGHT" boxes /t/?w=&h= may ask for
+	ThumbSizes []string `toml:"thumb_sizes"`
+
+	// NormalizeOrientation rotates JPEG and PNG uploads according to their
+	// EXIF orientation and drops the tag, re-encoding those that need turning
+	NormalizeOrientation bool `toml:"normalize_orientation"`
+
+	// APITokens, if there are any, are required to upload. TokenFile names
+	// a TOML file of more [[api_tokens]], so they can be kept apart from the
+	// rest of the config.
+	APITokens []APIToken `toml:"api_tokens"`
+	TokenFile string     `toml:"token_file"`
+
+	// OIDC, if it has an issuer, puts the upload page behind a login
+	OIDC OIDCConfig `toml:"oidc"`
+
+	// UploadRate limits requests to /upload and /url, and ThumbRate to /t/,
+	// per API token or, without one, per client IP
+	UploadRate RateLimitConfig `toml:"upload_rate"`
+	ThumbRate  RateLimitConfig `toml:"thumb_rate"`
+
+	// DailyUploads and DailyBytes cap what each API token or signed-in user
+	// may store per UTC day, unless a token sets its own; zero is no cap
+	DailyUploads int64 `toml:"daily_uploads"`
+	DailyBytes   int64 `toml:"daily_bytes"`
+
+	// TrustedProxies lists CIDRs (or single addresses) of reverse proxies
+	// whose X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and
+	// Forwarded headers are believed
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// PublicURL, like "https://img.example.com", is used for every link we
+	// hand out instead of working it out from each request
+	PublicURL string `toml:"public_url"`
+
+	// TLS, if it has a certificate or ACME domains, serves HTTPS on Bind
+	TLS TLSConfig `toml:"tls"`
+}
+
+// DefaultConfig returns the configuration used when nothing else is specified
+func DefaultConfig() Config {
+	maxRedirects := defaultFetchMaxRedirects
+	return Config{
+		Bind:       "0.0.0.0:3000",
+		ServePath:  "/i/",
+		UploadPath: "./uploads/",
+
+		MaxUploadBytes: defaultMaxUploadBytes,
+		MaxPixels:      defaultMaxPixels,
+
+		FetchConnectTimeout: defaultFetchConnectTimeout,
+		FetchTimeout:        defaultFetchTimeout,
+		FetchMaxBytes:       defaultFetchMaxBytes,
+		FetchMaxRedirects:   &maxRedirects,
+
+		ThumbCacheBytes: defaultThumbCacheBytes,
+		ThumbSizes:      defaultThumbSizes,
+	}
+}
+
+//go:embed templates
+var templatesFolder embed.FS
+
+// Server holds everything needed to serve one image store
+type Server struct {
+	config     Config
+	images     *ImageIndex
+	hashDb     *hashDB
+	storage    storage
+	mimeTypes  *MimeTypeHandler
+	tus        *tusStore
+	thumbs     *thumbCache
+	thumbSizes map[thumbSize]bool
+	apiTokens  map[string]APIToken
+	oidc       *oidcProvider
+	sessionKey []byte
+	fetcher    *http.Client
+	mux        *http.ServeMux
+
+	uploadLimiter  *rateLimiter
+	thumbLimiter   *rateLimiter
+	quotas         *quotaTracker
+	trustedProxies []netip.Prefix
+	publicURL      *url.URL
+
+	tlsConfig *tls.Config
+	acme      *autocert.Manager
+
+	mu             sync.Mutex
+	httpServer     *http.Server
+	listener       net.Listener
+	redirectServer *http.Server
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+// New creates a Server from config, creating the upload directory and
+// loading the hash index. Empty config values fall back to DefaultConfig.
+func New(config Config) (*Server, error) {
+	defaults := DefaultConfig()
+	if config.Bind == "" {
+		config.Bind = defaults.Bind
+	}
+	if config.ServePath == "" {
+		config.ServePath = defaults.ServePath
+	}
+	if config.UploadPath == "" {
+		config.UploadPath = defaults.UploadPath
+	}
+	if config.MaxUploadBytes == 0 {
+		config.MaxUploadBytes = defaults.MaxUploadBytes
+	}
+	if config.MaxPixels == 0 {
+		config.MaxPixels = defaults.MaxPixels
+	}
+	if config.FetchConnectTimeout == 0 {
+		config.FetchConnectTimeout = defaults.FetchConnectTimeout
+	}
+	if config.FetchTimeout == 0 {
+		config.FetchTimeout = defaults.FetchTimeout
+	}
+	if config.FetchMaxBytes == 0 {
+		config.FetchMaxBytes = defaults.FetchMaxBytes
+	}
+	if config.FetchMaxRedirects == nil {
+		config.FetchMaxRedirects = defaults.FetchMaxRedirects
+	}
+
+	if config.ThumbCacheBytes == 0 {
+		config.ThumbCacheBytes = defaults.ThumbCacheBytes
+	}
+	if len(config.ThumbSizes) == 0 {
+		config.ThumbSizes = defaults.ThumbSizes
+	}
+	if config.ThumbCachePath == "" {
+		config.ThumbCachePath = filepath.Join(config.UploadPath, defaultThumbCacheDir)
+	}
+
+	if config.DefaultTTL < 0 || config.MaxTTL < 0 {
+		return nil, fmt.Errorf("default_ttl and max_ttl must not be negative")
+	}
+	if config.MaxUploadBytes < 0 || config.MaxPixels < 0 {
+		return nil, fmt.Errorf("max_upload_bytes and max_pixels must not be negative")
+	}
+	if config.ThumbCacheBytes < 0 {
+		return nil, fmt.Errorf("thumb_cache_bytes must not be negative")
+	}
+	if *config.FetchMaxRedirects < 0 {
+		return nil, fmt.Errorf("fetch_max_redirects must not be negative")
+	}
+	if config.UploadRate.Rate < 0 || config.UploadRate.Burst < 0 || config.ThumbRate.Rate < 0 || config.ThumbRate.Burst < 0 {
+		return nil, fmt.Errorf("upload_rate and thumb_rate must not be negative")
+	}
+	if config.DailyUploads < 0 || config.DailyBytes < 0 {
+		return nil, fmt.Errorf("daily_uploads and daily_bytes must not be negative")
+	}
+
+	trustedProxies, err := parsePrefixes("trusted_proxies", config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	publicURL, err := parsePublicURL(config.PublicURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, acme, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbSizes, err := parseThumbSizes(config.ThumbSizes)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := config.APITokens
+	if config.TokenFile != "" {
+		fileTokens, err := loadTokenFile(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(slices.Clip(tokens), fileTokens...)
+	}
+	apiTokens, err := parseAPITokens(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	var oidc *oidcProvider
+	var sessionKey []byte
+	if config.OIDC.Issuer != "" {
+		if oidc, err = newOIDCProvider(config.OIDC); err != nil {
+			return nil, err
+		}
+		sessionKey = []byte(config.OIDC.SessionSecret)
+		if len(sessionKey) == 0 {
+			sessionKey = make([]byte, 32)
+			if _, err := rand.Read(sessionKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fetcher, err := newFetchClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the upload directory if it doesn't exist
+	if _, err := os.Stat(config.UploadPath); os.IsNotExist(err) {
+		fmt.Printf("Creating upload directory at %s\n", config.UploadPath)
+		if err := os.MkdirAll(config.UploadPath, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("error creating upload directory: %w", err)
+		}
+	}
+
+	hashDb, err := openHashDB(filepath.Join(config.UploadPath, hashIndexFile))
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStorage(config)
+	if err != nil {
+		hashDb.Close()
+		return nil, err
+	}
+
+	images, err := buildHashDict(store, hashDb)
+	if err != nil {
+		hashDb.Close()
+		return nil, err
+	}
+
+	tus, err := newTusStore(config.UploadPath)
+	if err != nil {
+		hashDb.Close()
+		return nil, err
+	}
+
+	thumbs, err := newThumbCache(config.ThumbCachePath, config.ThumbCacheBytes)
+	if err != nil {
+		hashDb.Close()
+		return nil, err
+	}
+
+	if config.Debug {
+		images.Range(func(filename string, rec hashRecord) bool {
+			fmt.Printf("MD5 Hash: %s, Filename: %s\n", rec.Hash, filename)
+			return true
+		})
+	}
+
+	s := &Server{
+		config:     config,
+		images:     images,
+		hashDb:     hashDb,
+		storage:    store,
+		mimeTypes:  newMimeTypeHandler(),
+		tus:        tus,
+		thumbs:     thumbs,
+		thumbSizes: thumbSizes,
+		apiTokens:  apiTokens,
+		oidc:       oidc,
+		sessionKey: sessionKey,
+		fetcher:    fetcher,
+		mux:        http.NewServeMux(),
+		stop:       make(chan struct{}),
+
+		uploadLimiter:  newRateLimiter(config.UploadRate),
+		thumbLimiter:   newRateLimiter(config.ThumbRate),
+		trustedProxies: trustedProxies,
+		publicURL:      publicURL,
+
+		tlsConfig: tlsConfig,
+		acme:      acme,
+	}
+	s.quotas = newQuotaTracker(s.quotaLimits, images)
+	s.routes()
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.runReaper(s.stop)
+	}()
+
+	return s, nil
+}
+
+func (s *Server) routes() {
+	s.mux.HandleFunc("/livez", s.livezHandler)
+	s.mux.HandleFunc("/readyz", s.readyzHandler)
+	s.mux.HandleFunc("/t/", s.rateLimit(s.thumbLimiter, s.serveThumbnailImageHandler))
+	s.mux.HandleFunc("/upload", s.rateLimit(s.uploadLimiter, s.requireScope(scopeUpload, s.uploadHandler)))
+	s.mux.HandleFunc("/upload/", s.rateLimit(s.uploadLimiter, s.requireScope(scopeUpload, s.rawUploadHandler)))
+	s.mux.HandleFunc("/url", s.rateLimit(s.uploadLimiter, s.requireScope(scopeUpload, s.urlUploadHandler)))
+	s.mux.HandleFunc(tusPath, s.requireScope(scopeUpload, s.tusHandler))
+	s.mux.HandleFunc(strings.TrimSuffix(tusPath, "/"), s.requireScope(scopeUpload, s.tusHandler))
+	s.mux.HandleFunc("OPTIONS "+tusPath, s.tusOptionsHandler)
+	s.mux.HandleFunc("OPTIONS "+strings.TrimSuffix(tusPath, "/"), s.tusOptionsHandler)
+	s.mux.HandleFunc(s.config.ServePath, s.serveImageHandler)
+	s.mux.HandleFunc("DELETE "+s.config.ServePath, s.deleteImageHandler)
+	s.mux.HandleFunc("/d/", s.deletePageHandler)
+	s.mux.HandleFunc("GET /{$}", s.requireLogin(s.staticHandler))
+	s.mux.HandleFunc("GET /index.html", s.requireLogin(s.staticHandler))
+	s.mux.HandleFunc("/", s.staticHandler)
+
+	if s.oidc != nil {
+		s.mux.HandleFunc("GET "+authLoginPath, s.loginHandler)
+		s.mux.HandleFunc("GET "+authCallbackPath, s.callbackHandler)
+		s.mux.HandleFunc("POST "+authLogoutPath, s.logoutHandler)
+	}
+}
+
+// Config returns the configuration the server is running with
+func (s *Server) Config() Config {
+	return s.config
+}
+
+// Handler returns the HTTP handler serving the upload UI, API and images
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Start listens on the configured bind address and serves requests until
+// Shutdown is called, at which point it returns http.ErrServerClosed. With
+// TLS configured it serves HTTPS, and plain HTTP redirects on RedirectBind.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.config.Bind)
+	if err != nil {
+		return err
+	}
+
+	var redirectLn net.Listener
+	if s.tlsConfig != nil && s.config.TLS.RedirectBind != "" {
+		if redirectLn, err = net.Listen("tcp", s.config.TLS.RedirectBind); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.httpServer == nil {
+		s.httpServer = &http.Server{Handler: s.Handler(), TLSConfig: s.tlsConfig}
+	}
+	httpServer := s.httpServer
+	s.listener = ln
+	if redirectLn != nil {
+		s.redirectServer = &http.Server{Handler: s.redirectHandler()}
+	}
+	redirectServer := s.redirectServer
+	s.mu.Unlock()
+
+	if redirectLn != nil {
+		// Stop redirecting once we're no longer serving, even if Shutdown
+		// came before Start
+		defer redirectServer.Close()
+		go func() {
+			if err := redirectServer.Serve(redirectLn); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Error serving HTTP redirects: %v\n", err)
+			}
+		}()
+	}
+
+	if s.tlsConfig != nil {
+		// The certificate comes from TLSConfig.GetCertificate
+		return httpServer.ServeTLS(ln, "", "")
+	}
+	return httpServer.Serve(ln)
+}
+
+// Shutdown gracefully stops a started server and releases the hash index.
+// It must be called even if the server was only used through Handler.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.httpServer == nil {
+		// Make any later Start return straight away
+		s.httpServer = &http.Server{Handler: s.Handler(), TLSConfig: s.tlsConfig}
+	}
+	httpServer := s.httpServer
+	redirectServer := s.redirectServer
+	s.mu.Unlock()
+
+	err := httpServer.Shutdown(ctx)
+	if redirectServer != nil {
+		err = errors.Join(err, redirectServer.Shutdown(ctx))
+	}
+
+	// Background workers use the index, so stop them before closing it
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.workers.Wait()
+
+	return errors.Join(err, s.hashDb.Close())
+}
+
+func (s *Server) staticHandler(w http.ResponseWriter, r *http.Request) {
+	filePath := path.Join("templates", r.URL.Path)
+	if r.URL.Path == "/" {
+		filePath = "templates/index.html"
+	}
+	file, err := templatesFolder.Open(filePath)
+	if err != nil {
+		notfoundHandler(w, r)
+		return
+	}
+	defer file.Close()
+
+	io.Copy(w, file)
+}
@@ -0,0 +1,107 @@
+package grombley
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServersAreIndependent(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rr, uploadRequest(t, testPNG(t, 10)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	url := strings.TrimSpace(rr.Body.String())
+	name := url[strings.LastIndex(url, "/")+1:]
+
+	if a.images.Count() != 1 {
+		t.Errorf("expected 1 image on server a, got %d", a.images.Count())
+	}
+	if b.images.Count() != 0 {
+		t.Errorf("expected 0 images on server b, got %d", b.images.Count())
+	}
+
+	rr = httptest.NewRecorder()
+	a.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/i/"+name, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected server a to serve %s, got %d", name, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	b.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/i/"+name, nil))
+	if body := rr.Body.String(); !strings.Contains(body, "Fenton Not Found") {
+		t.Errorf("expected server b to 404 for %s, got %d", name, rr.Code)
+	}
+}
+
+func TestServerCustomServePath(t *testing.T) {
+	s, err := New(Config{UploadPath: t.TempDir(), ServePath: "/pics/"})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, uploadRequest(t, testPNG(t, 20)))
+	if url := rr.Body.String(); !strings.Contains(url, "/pics/") {
+		t.Errorf("expected URL under /pics/, got %q", url)
+	}
+}
+
+func TestServerStartShutdown(t *testing.T) {
+	s, err := New(Config{Bind: "127.0.0.1:0", UploadPath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+
+	// Wait for the listener to come up
+	var addr string
+	for i := 0; i < 100 && addr == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		if s.listener != nil {
+			addr = s.listener.Addr().String()
+		}
+		s.mu.Unlock()
+	}
+	if addr == "" {
+		t.Fatal("server did not start listening")
+	}
+
+	resp, err := http.Get("http://" + addr + "/readyz")
+	if err != nil {
+		t.Fatalf("request to running server failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "200" {
+		t.Errorf("expected readyz to return 200, got %q", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("expected Start to return ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+}
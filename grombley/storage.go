@@ -0,0 +1,165 @@
+package grombley
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage backends selectable in Config
+const (
+	storageFS = "fs"
+	storageS3 = "s3"
+)
+
+// storage is where image files live. Names are flat, with no directories;
+// missing files are reported with errors matching fs.ErrNotExist.
+//
+// Backends that can keep a fileMeta with the file do, so that another
+// instance sharing the storage knows everything the uploading one did; the
+// fs backend leaves it to the index beside the files. List may leave Meta
+// out, but Stat includes it.
+type storage interface {
+	Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error
+	Get(ctx context.Context, name string) (io.ReadSeekCloser, error)
+	Stat(ctx context.Context, name string) (fileInfo, error)
+	SetMeta(ctx context.Context, name string, meta fileMeta) error
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]fileInfo, error)
+}
+
+// fileInfo describes a stored file
+type fileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// Hash is the file's MD5 if the backend knows it without reading the
+	// file, as S3 does for most objects. It's of the stored bytes, so for
+	// our own uploads Meta.Hash is the one to go by.
+	Hash string
+	// Meta is nil if the backend doesn't keep metadata or the file has none
+	Meta *fileMeta
+}
+
+// fileMeta is the part of an image's index record that isn't about the file
+// itself. Hash is of the upload as received, before EXIF was stripped.
+type fileMeta struct {
+	Hash        string
+	DeleteToken string
+	Expires     time.Time
+	Uploader    string
+}
+
+// newStorage opens the backend config asks for
+func newStorage(config Config) (storage, error) {
+	switch config.Storage {
+	case "", storageFS:
+		return newFSStorage(config.UploadPath), nil
+	case storageS3:
+		return newS3Storage(config.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Storage)
+	}
+}
+
+// fsStorage keeps images as files in a directory, the original behavior
+type fsStorage struct {
+	dir string
+}
+
+func newFSStorage(dir string) *fsStorage {
+	return &fsStorage{dir: dir}
+}
+
+func (f *fsStorage) path(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid file name %q: %w", name, fs.ErrInvalid)
+	}
+	return filepath.Join(f.dir, name), nil
+}
+
+// Put writes to a temporary file first so a half-written image is never
+// served. Metadata is left to the index.
+func (f *fsStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".put-*")
+	if err != nil {
+		return fmt.Errorf("error creating the file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error copying file data: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *fsStorage) Get(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (f *fsStorage) Stat(ctx context.Context, name string) (fileInfo, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	return fileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (f *fsStorage) SetMeta(ctx context.Context, name string, meta fileMeta) error {
+	return nil
+}
+
+func (f *fsStorage) Delete(ctx context.Context, name string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// List skips dotfiles and directories: that's our own bookkeeping (the
+// index, tus staging and so on)
+func (f *fsStorage) List(ctx context.Context) ([]fileInfo, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []fileInfo
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fileInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
@@ -19,7 +19,7 @@ document.addEventListener("DOMContentLoaded", () => {
   });
 
   fileInputField.addEventListener("change", (e) => {
-    handleFileUpload(fileInputField.files[0]);
+    handleFilesUpload(Array.from(fileInputField.files));
   });
 
   dropArea.addEventListener("dragover", (e) => {
@@ -35,19 +35,18 @@ document.addEventListener("DOMContentLoaded", () => {
     e.preventDefault();
     dropArea.classList.remove("drag-over");
 
-    const file = e.dataTransfer.files[0];
-    handleFileUpload(file);
+    handleFilesUpload(Array.from(e.dataTransfer.files));
   });
 
   document.addEventListener("paste", (event) => {
     const clipboardData = event.clipboardData || window.clipboardData;
 
-    // handle image
-    const imageItem = Array.from(clipboardData.items).find((item) =>
-      item.type.includes("image")
-    );
-    if (imageItem) {
-      handleFileUpload(imageItem.getAsFile());
+    // handle images
+    const imageFiles = Array.from(clipboardData.items)
+      .filter((item) => item.type.includes("image"))
+      .map((item) => item.getAsFile());
+    if (imageFiles.length > 0) {
+      handleFilesUpload(imageFiles);
     }
 
     // handle url
@@ -65,12 +64,23 @@ document.addEventListener("DOMContentLoaded", () => {
     console.error("something goofed:", errorText);
   }
 
+  // Errors come back as problem+json since we ask for JSON; the detail is
+  // the human-readable part
+  async function errorMessage(response) {
+    const contentType = response.headers.get("Content-Type") || "";
+    if (!contentType.includes("json")) {
+      return response.text();
+    }
+    const problem = await response.json();
+    return problem.detail || problem.title || `error ${response.status}`;
+  }
+
   async function handleResponse(response) {
     if (response.ok) {
       const result = await response.json();
       window.location.href = result.url;
     } else {
-      const errorText = await response.text();
+      const errorText = await errorMessage(response);
       handleError(errorText.toLowerCase());
     }
   }
@@ -86,6 +96,58 @@ document.addEventListener("DOMContentLoaded", () => {
     ready();
   }
 
+  function showBatchResults(results) {
+    const list = document.getElementById("results");
+    list.replaceChildren();
+    for (const result of results) {
+      const item = document.createElement("li");
+      if (result.error) {
+        item.className = "failed";
+        item.textContent = `⚠ ${result.filename}: ${result.error.toLowerCase()}`;
+      } else {
+        const link = document.createElement("a");
+        link.href = result.url;
+        link.textContent = result.url;
+        item.appendChild(link);
+      }
+      list.appendChild(item);
+    }
+  }
+
+  async function handleBatchUpload(files) {
+    const formData = new FormData();
+    for (const file of files) {
+      formData.append("files", file);
+    }
+    busy();
+    try {
+      const response = await fetch("/upload", {
+        method: "POST",
+        headers: {
+          Accept: "application/json",
+        },
+        body: formData,
+      });
+      if (response.ok) {
+        showBatchResults(await response.json());
+      } else {
+        const errorText = await errorMessage(response);
+        handleError(errorText.toLowerCase());
+      }
+    } catch (error) {
+      console.error("Error:", error);
+    }
+    ready();
+  }
+
+  function handleFilesUpload(files) {
+    if (files.length === 1) {
+      handleFileUpload(files[0]);
+    } else if (files.length > 1) {
+      handleBatchUpload(files);
+    }
+  }
+
   function handleFileUpload(file) {
     const formData = new FormData();
     formData.append("file", file);
@@ -0,0 +1,256 @@
+package grombley
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Generated thumbnails, and WebP copies of images, are kept on disk so a
+// popular image is only decoded once. Each source image gets a directory
+// named after it holding one file per set of thumbnail parameters, which
+// makes dropping all of an image's thumbnails a single RemoveAll. The least
+// recently used thumbnails are evicted once the cache grows past its size
+// cap.
+
+const (
+	defaultThumbCacheDir   = ".thumbs"
+	defaultThumbCacheBytes = 256 << 20
+)
+
+// thumbExtensions maps the content types we cache to the extension the
+// cached file is stored with, so a hit knows its type without decoding
+var thumbExtensions = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// thumbEntry is one cached thumbnail
+type thumbEntry struct {
+	name        string
+	params      string
+	contentType string
+	size        int64
+}
+
+func (e *thumbEntry) key() string {
+	return e.name + "/" + e.params
+}
+
+// thumbCache is a size-capped LRU cache of thumbnails on disk
+type thumbCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *thumbEntry, most recently used at the front
+	entries map[string]*list.Element
+}
+
+// newThumbCache opens the cache in dir, picking up thumbnails left there by
+// a previous run in order of when they were last used
+func newThumbCache(dir string, maxBytes int64) (*thumbCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating thumbnail cache directory: %w", err)
+	}
+	c := &thumbCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	type found struct {
+		entry   *thumbEntry
+		modTime time.Time
+	}
+	var existing []found
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name, file, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		contentType, params := thumbContentType(file)
+		if !ok || strings.Contains(file, "/") || contentType == "" {
+			// Leftover temporary file or something that isn't ours
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		existing = append(existing, found{
+			entry:   &thumbEntry{name: name, params: params, contentType: contentType, size: info.Size()},
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading thumbnail cache: %w", err)
+	}
+
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.Before(existing[j].modTime)
+	})
+	for _, f := range existing {
+		c.entries[f.entry.key()] = c.lru.PushFront(f.entry)
+		c.size += f.entry.size
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// thumbContentType works out a cached file's type and parameters from its name
+func thumbContentType(file string) (string, string) {
+	for contentType, ext := range thumbExtensions {
+		if params, ok := strings.CutSuffix(file, ext); ok && params != "" {
+			return contentType, params
+		}
+	}
+	return "", ""
+}
+
+func (c *thumbCache) path(e *thumbEntry) string {
+	return filepath.Join(c.dir, e.name, e.params+thumbExtensions[e.contentType])
+}
+
+// get returns the cached thumbnail of name made with params, if there is one
+func (c *thumbCache) get(name, params string) ([]byte, string, bool) {
+	c.mu.Lock()
+	elem, ok := c.entries[name+"/"+params]
+	if !ok {
+		c.mu.Unlock()
+		return nil, "", false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*thumbEntry)
+	path := c.path(entry)
+	c.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// Removed from under us; forget it and regenerate
+		c.mu.Lock()
+		if c.entries[entry.key()] == elem {
+			c.remove(elem)
+		}
+		c.mu.Unlock()
+		return nil, "", false
+	}
+
+	// Keep the file's age in step so the order survives a restart
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return data, entry.contentType, true
+}
+
+// put stores a thumbnail of name made with params, evicting older thumbnails
+// to stay under the size cap
+func (c *thumbCache) put(name, params, contentType string, data []byte) error {
+	if _, ok := thumbExtensions[contentType]; !ok {
+		return fmt.Errorf("can't cache thumbnails of type %s", contentType)
+	}
+	if int64(len(data)) > c.maxBytes {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	entry := &thumbEntry{name: name, params: params, contentType: contentType, size: int64(len(data))}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(c.dir, name), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path(entry)); err != nil {
+		return err
+	}
+
+	if elem, ok := c.entries[entry.key()]; ok {
+		c.size -= elem.Value.(*thumbEntry).size
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.key()] = c.lru.PushFront(entry)
+	c.size += entry.size
+	c.evict()
+	return nil
+}
+
+// invalidate drops every cached thumbnail of name
+func (c *thumbCache) invalidate(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*thumbEntry)
+		if entry.name == name {
+			c.size -= entry.size
+			c.lru.Remove(elem)
+			delete(c.entries, entry.key())
+		}
+		elem = next
+	}
+	return os.RemoveAll(filepath.Join(c.dir, name))
+}
+
+// evict removes least recently used thumbnails until the cache fits. Empty
+// entries, which record that there's nothing to make (noWebPVariant), free
+// no space, so they're kept. The caller must hold c.mu.
+func (c *thumbCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.size > c.maxBytes; {
+		prev := elem.Prev()
+		if elem.Value.(*thumbEntry).size > 0 {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// remove deletes one thumbnail and its file. The caller must hold c.mu.
+func (c *thumbCache) remove(elem *list.Element) {
+	entry := elem.Value.(*thumbEntry)
+	c.size -= entry.size
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key())
+
+	os.Remove(c.path(entry))
+	// Drop the image's directory too once it's empty
+	os.Remove(filepath.Join(c.dir, entry.name))
+}
@@ -0,0 +1,124 @@
+package grombley
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, err := newThumbCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	// The oldest entry, but empty, so evicting it would free nothing
+	if err := c.put("z.png", "webp", "image/webp", noWebPVariant); err != nil {
+		t.Fatalf("put z.png failed: %v", err)
+	}
+
+	for _, name := range []string{"a.png", "b.png"} {
+		if err := c.put(name, "div4", "image/png", []byte("12345")); err != nil {
+			t.Fatalf("put %s failed: %v", name, err)
+		}
+	}
+	// Using a makes b the least recently used
+	if _, _, ok := c.get("a.png", "div4"); !ok {
+		t.Fatal("expected a.png to be cached")
+	}
+	if err := c.put("c.png", "div4", "image/png", []byte("12345")); err != nil {
+		t.Fatalf("put c.png failed: %v", err)
+	}
+
+	if _, _, ok := c.get("b.png", "div4"); ok {
+		t.Error("expected b.png to be evicted")
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "b.png")); !os.IsNotExist(err) {
+		t.Errorf("expected b.png's cache directory to be removed, got %v", err)
+	}
+	for _, name := range []string{"a.png", "c.png"} {
+		if _, _, ok := c.get(name, "div4"); !ok {
+			t.Errorf("expected %s to still be cached", name)
+		}
+	}
+	if _, _, ok := c.get("z.png", "webp"); !ok {
+		t.Error("expected the empty entry to be kept")
+	}
+	if c.size != 10 {
+		t.Errorf("expected cache size 10, got %d", c.size)
+	}
+}
+
+func TestThumbCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newThumbCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	if err := c.put("a.jpg", "div4", "image/jpeg", []byte("thumb")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	// A temporary file from an interrupted put
+	stray := filepath.Join(dir, ".put-123")
+	if err := os.WriteFile(stray, []byte("junk"), 0644); err != nil {
+		t.Fatalf("failed to write stray file: %v", err)
+	}
+
+	c, err = newThumbCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	data, contentType, ok := c.get("a.jpg", "div4")
+	if !ok || string(data) != "thumb" || contentType != "image/jpeg" {
+		t.Errorf("got %q, %q, %v after restart; want thumb, image/jpeg, true", data, contentType, ok)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("expected stray file to be cleaned up, got %v", err)
+	}
+}
+
+func TestThumbnailCachedAndInvalidated(t *testing.T) {
+	s := newTestServer(t)
+	result := uploadJSON(t, s, testPNG(t, 70))
+	name := imageNameFromURL(result.URL)
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("thumbnail failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	first := rr.Body.Bytes()
+
+	cached, contentType, ok := s.thumbs.get(name, thumbSpec{}.params())
+	if !ok {
+		t.Fatal("expected the thumbnail to be cached")
+	}
+	if !bytes.Equal(cached, first) || contentType != "image/png" {
+		t.Errorf("cached thumbnail doesn't match what was served")
+	}
+
+	// A hit is served from the cache without touching the original
+	if err := os.Remove(filepath.Join(s.config.UploadPath, name)); err != nil {
+		t.Fatalf("failed to remove original: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name, nil))
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), first) {
+		t.Errorf("expected cached thumbnail, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected Content-Type image/png, got %s", ct)
+	}
+
+	if err := s.removeImage(name); err != nil {
+		t.Fatalf("removeImage failed: %v", err)
+	}
+	if _, _, ok := s.thumbs.get(name, thumbSpec{}.params()); ok {
+		t.Error("expected deleting the image to drop its thumbnail")
+	}
+	if _, err := os.Stat(filepath.Join(s.config.ThumbCachePath, name)); !os.IsNotExist(err) {
+		t.Errorf("expected thumbnail directory to be removed, got %v", err)
+	}
+}
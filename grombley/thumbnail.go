@@ -0,0 +1,292 @@
+package grombley
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// How a thumbnail fills its bounding box: contain fits the whole image inside
+// it, cover fills it and crops what sticks out
+const (
+	fitContain = "contain"
+	fitCover   = "cover"
+)
+
+// defaultThumbSizes are the bounding boxes /t/ accepts unless configured
+var defaultThumbSizes = []string{"160x160", "320x240", "640x480"}
+
+// thumbSize is a bounding box in pixels
+type thumbSize struct {
+	Width, Height int
+}
+
+// thumbSpec describes the thumbnail a request wants. The zero value is the
+// original quarter-size thumbnail.
+type thumbSpec struct {
+	thumbSize
+	Fit string
+	// Static asks for a still of an animated GIF's first frame
+	Static bool
+}
+
+// params identifies the thumbnail in the cache
+func (t thumbSpec) params() string {
+	params := "div4"
+	if t.Width != 0 {
+		params = fmt.Sprintf("%dx%d-%s", t.Width, t.Height, t.Fit)
+	}
+	if t.Static {
+		params += "-static"
+	}
+	return params
+}
+
+// parseThumbSizes turns "WIDTHxHEIGHT" strings into the set of allowed boxes
+func parseThumbSizes(sizes []string) (map[thumbSize]bool, error) {
+	allowed := make(map[thumbSize]bool, len(sizes))
+	for _, size := range sizes {
+		w, h, ok := strings.Cut(strings.ToLower(strings.TrimSpace(size)), "x")
+		width, werr := strconv.Atoi(w)
+		height, herr := strconv.Atoi(h)
+		if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("invalid thumbnail size %q, want WIDTHxHEIGHT", size)
+		}
+		allowed[thumbSize{width, height}] = true
+	}
+	return allowed, nil
+}
+
+// thumbSpec reads w, h, fit and static from a /t/ request. Only configured
+// sizes are allowed, so clients can't fill the cache with one thumbnail per
+// pixel.
+func (s *Server) thumbSpec(query url.Values) (thumbSpec, error) {
+	var spec thumbSpec
+	if static := query.Get("static"); static != "" {
+		var err error
+		if spec.Static, err = strconv.ParseBool(static); err != nil {
+			return thumbSpec{}, fmt.Errorf("invalid static value %q", static)
+		}
+	}
+
+	w, h, fit := query.Get("w"), query.Get("h"), query.Get("fit")
+	if w == "" && h == "" && fit == "" {
+		return spec, nil
+	}
+
+	var err error
+	if spec.Width, err = strconv.Atoi(w); err != nil {
+		return thumbSpec{}, fmt.Errorf("invalid thumbnail width %q", w)
+	}
+	if spec.Height, err = strconv.Atoi(h); err != nil {
+		return thumbSpec{}, fmt.Errorf("invalid thumbnail height %q", h)
+	}
+	if !s.thumbSizes[spec.thumbSize] {
+		return thumbSpec{}, fmt.Errorf("thumbnail size %dx%d is not allowed", spec.Width, spec.Height)
+	}
+
+	switch fit {
+	case "", fitContain:
+		spec.Fit = fitContain
+	case fitCover:
+		spec.Fit = fitCover
+	default:
+		return thumbSpec{}, fmt.Errorf("invalid thumbnail fit %q, want contain or cover", fit)
+	}
+	return spec, nil
+}
+
+// Serve thumbnail: 1/4 size, or fitted to ?w=&h=&fit=
+func (s *Server) serveThumbnailImageHandler(w http.ResponseWriter, r *http.Request) {
+	imageName := filepath.Base(r.URL.Path)
+	if err := validateImageName(imageName, s.config.UploadPath); err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	spec, err := s.thumbSpec(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	params := spec.params()
+	if s.checkExpired(w, r, imageName) {
+		return
+	}
+
+	// Only cache thumbnails of indexed images: deleting one through the index
+	// is what invalidates its thumbnails
+	_, indexed := s.images.LookupName(imageName)
+
+	var thumbnailData []byte
+	var contentType string
+	var ok bool
+	if indexed {
+		thumbnailData, contentType, ok = s.thumbs.get(imageName, params)
+	}
+	if !ok {
+		if thumbnailData, contentType, ok = s.generateThumbnail(w, r, imageName, spec); !ok {
+			return
+		}
+		if indexed {
+			if err := s.thumbs.put(imageName, params, contentType, thumbnailData); err != nil {
+				fmt.Printf("Error caching thumbnail of %s: %v\n", imageName, err)
+			} else if _, ok := s.images.LookupName(imageName); !ok {
+				// Deleted while we were busy; don't leave its thumbnail behind
+				s.thumbs.invalidate(imageName)
+			}
+		}
+	}
+
+	variant := params
+	if negotiateWebP(w, r, contentType) && indexed {
+		data := thumbnailData
+		if webp, ok := s.webpVariant(imageName, params+"-webp", func() ([]byte, error) { return data, nil }); ok {
+			thumbnailData, contentType, variant = webp, "image/webp", params+"-webp"
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	s.serveImageContent(w, r, imageName, variant, bytes.NewReader(thumbnailData))
+}
+
+// generateThumbnail reads an image from storage and makes its thumbnail,
+// writing an error response and returning false if that fails
+func (s *Server) generateThumbnail(w http.ResponseWriter, r *http.Request, imageName string, spec thumbSpec) ([]byte, string, bool) {
+	imageFile, err := s.storage.Get(r.Context(), imageName)
+	if err != nil {
+		notfoundHandler(w, r)
+		return nil, "", false
+	}
+	imageData, err := io.ReadAll(imageFile)
+	imageFile.Close()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to read image")
+		return nil, "", false
+	}
+
+	if err := s.checkPixels(bytes.NewReader(imageData)); err != nil {
+		writeError(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, s.tooManyPixelsMessage())
+		return nil, "", false
+	}
+
+	thumbnailData, contentType, err := makeThumbnail(imageData, spec)
+	if err != nil {
+		fmt.Printf("Error making thumbnail of %s: %v\n", imageName, err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to shrink image")
+		return nil, "", false
+	}
+	return thumbnailData, contentType, true
+}
+
+// makeThumbnail turns an image into the thumbnail spec asks for, returning
+// the encoded thumbnail and its content type
+func makeThumbnail(imageData []byte, spec thumbSpec) ([]byte, string, error) {
+	if isGIF(imageData) && !spec.Static {
+		if data, ok, err := animatedGIFThumbnail(imageData, spec); ok || err != nil {
+			return data, "image/gif", err
+		}
+	}
+
+	// Get the original orientation before shrinking
+	orientation := getImageOrientation(imageData)
+
+	// Shrink the image, still in its stored orientation
+	var dst image.Image
+	var format string
+	var err error
+	if spec.Width == 0 {
+		dst, format, err = shrinkImage(bytes.NewReader(imageData), 4)
+	} else {
+		// Orientations 5-8 turn the image sideways, so the box has to as well
+		if orientation >= 5 && orientation <= 8 {
+			spec.Width, spec.Height = spec.Height, spec.Width
+		}
+		dst, format, err = fitImage(bytes.NewReader(imageData), spec)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Turn the pixels the right way up rather than relying on clients to
+	// honor an orientation tag, which many don't for PNG
+	dst = orientImage(dst, orientation)
+
+	// PNG for anything that may be transparent or palette-based
+	var buf bytes.Buffer
+	if format == "png" || format == "gif" || (format == "webp" && !isOpaque(dst)) {
+		err = png.Encode(&buf, dst)
+		return buf.Bytes(), "image/png", err
+	}
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	return buf.Bytes(), "image/jpeg", err
+}
+
+// isOpaque reports whether img is known to have no transparent pixels
+func isOpaque(img image.Image) bool {
+	o, ok := img.(interface{ Opaque() bool })
+	return ok && o.Opaque()
+}
+
+// shrinkImage reduces the size of an image by the given factor and returns the new image and format.
+func shrinkImage(reader io.Reader, factor int) (image.Image, string, error) {
+	img, format, err := image.Decode(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	crop, newW, newH := thumbGeometry(img.Bounds(), thumbSpec{}, factor)
+	return resizeImage(img, crop, newW, newH), format, nil
+}
+
+// fitImage scales an image into spec's bounding box, cropping it to fill the
+// box for cover. Images are never enlarged, so a small image may come out
+// smaller than the box.
+func fitImage(reader io.Reader, spec thumbSpec) (image.Image, string, error) {
+	img, format, err := image.Decode(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	crop, newW, newH := thumbGeometry(img.Bounds(), spec, 0)
+	return resizeImage(img, crop, newW, newH), format, nil
+}
+
+// thumbGeometry works out which part of an image with the given bounds ends
+// up in the thumbnail and how big the thumbnail is. A spec without a size
+// shrinks the whole image by factor.
+func thumbGeometry(bounds image.Rectangle, spec thumbSpec, factor int) (image.Rectangle, int, int) {
+	if spec.Width == 0 {
+		return bounds, max(1, bounds.Dx()/factor), max(1, bounds.Dy()/factor)
+	}
+
+	srcW, srcH := float64(bounds.Dx()), float64(bounds.Dy())
+	scaleW, scaleH := float64(spec.Width)/srcW, float64(spec.Height)/srcH
+
+	if spec.Fit == fitCover {
+		scale := math.Min(math.Max(scaleW, scaleH), 1)
+		newW := min(spec.Width, scaledLength(srcW, scale))
+		newH := min(spec.Height, scaledLength(srcH, scale))
+
+		// Take the middle of the image in the box's proportions
+		cropW := min(bounds.Dx(), int(math.Round(float64(newW)/scale)))
+		cropH := min(bounds.Dy(), int(math.Round(float64(newH)/scale)))
+		x0 := bounds.Min.X + (bounds.Dx()-cropW)/2
+		y0 := bounds.Min.Y + (bounds.Dy()-cropH)/2
+		return image.Rect(x0, y0, x0+cropW, y0+cropH), newW, newH
+	}
+
+	scale := math.Min(math.Min(scaleW, scaleH), 1)
+	return bounds, scaledLength(srcW, scale), scaledLength(srcH, scale)
+}
+
+// scaledLength scales a side of an image, keeping at least one pixel
+func scaledLength(length, scale float64) int {
+	return max(1, int(math.Round(length*scale)))
+}
@@ -0,0 +1,182 @@
+package grombley
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeThumbnailImageHandler(t *testing.T) {
+	s := newTestServer(t)
+
+	// Copy the test image to the uploads directory
+	testImgSrc := "../tests/images/test.jpg"
+	testImgDst := filepath.Join(s.config.UploadPath, "test.jpg")
+	imgData, err := os.ReadFile(testImgSrc)
+	if err != nil {
+		t.Fatalf("failed to read test image: %v", err)
+	}
+	if err := os.WriteFile(testImgDst, imgData, 0644); err != nil {
+		t.Fatalf("failed to copy test image: %v", err)
+	}
+	defer os.Remove(testImgDst)
+
+	// Create request and recorder
+	req := httptest.NewRequest("GET", "/t/test.jpg", nil)
+	rr := httptest.NewRecorder()
+
+	s.serveThumbnailImageHandler(rr, req)
+
+	resp := rr.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("expected Content-Type image/jpeg, got %s", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if len(body) == 0 {
+		t.Errorf("response body is empty")
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail image: %v", err)
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != 568 || bounds.Dy() != 426 {
+		t.Errorf("thumbnail image has dimensions %d,%d; want 568,426", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestShrinkImage(t *testing.T) {
+
+	file, err := os.Open("../tests/images/test.jpg")
+	if err != nil {
+		t.Fatalf("failed to open test image: %v", err)
+	}
+	defer file.Close()
+
+	shrunk, format, err := shrinkImage(file, 4)
+	if err != nil {
+		t.Fatalf("shrinkImage failed: %v", err)
+	}
+	if format != "jpeg" {
+		t.Errorf("expected format 'jpeg', got '%s'", format)
+	}
+
+	bounds := shrunk.Bounds()
+	if bounds.Dx() != 568 || bounds.Dy() != 426 {
+		t.Errorf("shrunk image has dimensions %d,%d; want 568,426", bounds.Dx(), bounds.Dy())
+	}
+
+	// Make sure we've created a valid jpeg
+	outFile, err := os.CreateTemp("", "shrunk_test_*.jpg")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	if err := jpeg.Encode(outFile, shrunk, &jpeg.Options{Quality: 85}); err != nil {
+		t.Errorf("failed to encode shrunk image: %v", err)
+	}
+}
+
+func TestFitImage(t *testing.T) {
+	// test.jpg is 2272x1704
+	testCases := []struct {
+		spec          thumbSpec
+		width, height int
+	}{
+		{thumbSpec{thumbSize: thumbSize{320, 240}, Fit: fitContain}, 320, 240},
+		{thumbSpec{thumbSize: thumbSize{160, 160}, Fit: fitContain}, 160, 120},
+		{thumbSpec{thumbSize: thumbSize{160, 160}, Fit: fitCover}, 160, 160},
+		{thumbSpec{thumbSize: thumbSize{240, 320}, Fit: fitCover}, 240, 320},
+		// Never enlarged
+		{thumbSpec{thumbSize: thumbSize{4000, 4000}, Fit: fitContain}, 2272, 1704},
+		{thumbSpec{thumbSize: thumbSize{4000, 1000}, Fit: fitCover}, 2272, 1000},
+	}
+
+	data, err := os.ReadFile("../tests/images/test.jpg")
+	if err != nil {
+		t.Fatalf("failed to read test image: %v", err)
+	}
+
+	for _, tc := range testCases {
+		img, format, err := fitImage(bytes.NewReader(data), tc.spec)
+		if err != nil {
+			t.Fatalf("fitImage(%s) failed: %v", tc.spec.params(), err)
+		}
+		if format != "jpeg" {
+			t.Errorf("fitImage(%s) format = %s, want jpeg", tc.spec.params(), format)
+		}
+		if b := img.Bounds(); b.Dx() != tc.width || b.Dy() != tc.height {
+			t.Errorf("fitImage(%s) = %dx%d, want %dx%d", tc.spec.params(), b.Dx(), b.Dy(), tc.width, tc.height)
+		}
+	}
+}
+
+func TestThumbnailSizeParameters(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{ThumbSizes: []string{"320x240"}})
+
+	imgData, err := os.ReadFile("../tests/images/test.jpg")
+	if err != nil {
+		t.Fatalf("failed to read test image: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.config.UploadPath, "test.jpg"), imgData, 0644); err != nil {
+		t.Fatalf("failed to copy test image: %v", err)
+	}
+
+	testCases := []struct {
+		query         string
+		status        int
+		width, height int
+	}{
+		{"?w=320&h=240", http.StatusOK, 320, 240},
+		{"?w=320&h=240&fit=cover", http.StatusOK, 320, 240},
+		{"?w=160&h=160", http.StatusBadRequest, 0, 0},
+		{"?w=320", http.StatusBadRequest, 0, 0},
+		{"?w=320&h=240&fit=stretch", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/test.jpg"+tc.query, nil))
+		if rr.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.query, tc.status, rr.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		img, _, err := image.Decode(rr.Body)
+		if err != nil {
+			t.Fatalf("%s: failed to decode thumbnail: %v", tc.query, err)
+		}
+		if b := img.Bounds(); b.Dx() != tc.width || b.Dy() != tc.height {
+			t.Errorf("%s: thumbnail is %dx%d, want %dx%d", tc.query, b.Dx(), b.Dy(), tc.width, tc.height)
+		}
+	}
+}
+
+func TestParseThumbSizes(t *testing.T) {
+	sizes, err := parseThumbSizes([]string{"320x240", " 64X64 "})
+	if err != nil {
+		t.Fatalf("parseThumbSizes failed: %v", err)
+	}
+	if !sizes[thumbSize{320, 240}] || !sizes[thumbSize{64, 64}] || len(sizes) != 2 {
+		t.Errorf("unexpected sizes %v", sizes)
+	}
+
+	for _, bad := range []string{"320", "0x10", "ax10", "10x-1"} {
+		if _, err := parseThumbSizes([]string{bad}); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
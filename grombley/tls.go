@@ -0,0 +1,292 @@
+package grombley
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig serves HTTPS directly, from a certificate and key on disk or
+// with certificates issued by an ACME CA such as Let's Encrypt
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files, reloaded when they change
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	ACME ACMEConfig `toml:"acme"`
+
+	// RedirectBind, like ":80", listens for plain HTTP and redirects it to
+	// HTTPS, answering ACME HTTP-01 challenges on the way
+	RedirectBind string `toml:"redirect_bind"`
+}
+
+// ACMEConfig gets certificates for Domains as they're first asked for and
+// renews them before they expire. Setting it accepts the CA's terms of
+// service.
+type ACMEConfig struct {
+	Domains []string `toml:"domains"`
+	Email   string   `toml:"email"`
+	// DirectoryURL defaults to Let's Encrypt
+	DirectoryURL string `toml:"directory_url"`
+	// CacheDir keeps the account key and certificates; UploadPath/.acme by
+	// default
+	CacheDir string `toml:"cache_dir"`
+	// CAFile is a PEM bundle to trust when talking to the ACME server
+	// itself, for test CAs like Pebble
+	CAFile string `toml:"ca_file"`
+}
+
+// certCheckInterval is how often a certificate on disk is checked for changes
+const certCheckInterval = 10 * time.Second
+
+// maxACMEResponseBytes caps how much of a new order response is read
+const maxACMEResponseBytes = 1 << 20
+
+// newTLSConfig returns nil if config doesn't ask for TLS. The autocert
+// manager is only set for ACME, since it also has to answer HTTP-01
+// challenges on the redirect listener.
+func newTLSConfig(config Config) (*tls.Config, *autocert.Manager, error) {
+	tc := config.TLS
+	static := tc.CertFile != "" || tc.KeyFile != ""
+	switch {
+	case static && len(tc.ACME.Domains) > 0:
+		return nil, nil, fmt.Errorf("tls takes cert_file and key_file or acme domains, not both")
+	case static && (tc.CertFile == "" || tc.KeyFile == ""):
+		return nil, nil, fmt.Errorf("tls cert_file and key_file must be set together")
+	case static:
+		certs, err := newCertReloader(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}, nil, nil
+	case len(tc.ACME.Domains) > 0:
+		manager, err := newACMEManager(tc.ACME, config.UploadPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig := manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, manager, nil
+	case tc.RedirectBind != "":
+		return nil, nil, fmt.Errorf("tls redirect_bind needs cert_file and key_file or acme domains")
+	}
+	return nil, nil, nil
+}
+
+func newACMEManager(config ACMEConfig, uploadPath string) (*autocert.Manager, error) {
+	for _, domain := range config.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/:*") {
+			return nil, fmt.Errorf("tls acme domain %q must be a plain host name", domain)
+		}
+	}
+
+	cacheDir := config.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(uploadPath, ".acme")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tls acme ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls acme ca_file %s has no certificates", config.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	client := &acme.Client{
+		DirectoryURL: config.DirectoryURL,
+		HTTPClient:   &http.Client{Transport: newOrderLocations(transport)},
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Email:      config.Email,
+		Client:     client,
+	}, nil
+}
+
+// orderLocations fills in the Location of finalize responses that leave it
+// out, as Pebble does. The acme package polls that URL while the CA issues
+// the certificate, so without it issuance fails. Each new order's URL is
+// remembered by its finalize URL to fill it in from.
+type orderLocations struct {
+	next http.RoundTripper
+
+	mu     sync.Mutex
+	orders map[string]string
+}
+
+func newOrderLocations(next http.RoundTripper) *orderLocations {
+	return &orderLocations{next: next, orders: make(map[string]string)}
+}
+
+func (t *orderLocations) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost {
+		return res, err
+	}
+
+	location := res.Header.Get("Location")
+	if location == "" {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if order, ok := t.orders[req.URL.String()]; ok {
+			res.Header.Set("Location", order)
+			delete(t.orders, req.URL.String())
+		}
+		return res, nil
+	}
+
+	// New orders are 201 Created with their finalize URL in the body
+	if res.StatusCode == http.StatusCreated {
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxACMEResponseBytes))
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+
+		var order struct {
+			Finalize string `json:"finalize"`
+		}
+		if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+			t.mu.Lock()
+			t.orders[order.Finalize] = location
+			t.mu.Unlock()
+		}
+	}
+	return res, nil
+}
+
+// certReloader serves a certificate from disk, picking up renewals without a
+// restart. A certificate that fails to load (say, half written) is skipped
+// and the previous one kept until the next check.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, now: time.Now}
+	if err := c.reload(); err != nil {
+		return nil, fmt.Errorf("error loading tls certificate: %w", err)
+	}
+	c.checked = c.now()
+	return c, nil
+}
+
+// reload loads the certificate again if either file has changed
+func (c *certReloader) reload() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.certMod, c.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := c.now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		if err := c.reload(); err != nil {
+			fmt.Printf("Error reloading TLS certificate, keeping the old one: %v\n", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// redirectHandler sends plain HTTP requests to the same place over HTTPS,
+// except for ACME HTTP-01 challenges
+func (s *Server) redirectHandler() http.Handler {
+	handler := http.HandlerFunc(s.redirectToHTTPS)
+	if s.acme == nil {
+		return handler
+	}
+	challenges := s.acme.HTTPHandler(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The host policy doesn't allow for a port, which CAs validating on
+		// another port than 80 (Pebble, say) send
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			r = r.Clone(r.Context())
+			r.Host = host
+		}
+		challenges.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	target := s.httpsOrigin(r) + r.URL.RequestURI()
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Keep the method and body
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, target, code)
+}
+
+// httpsOrigin is where a plain HTTP request should have gone: PublicURL if
+// it's HTTPS, otherwise the host it was sent to on our HTTPS port
+func (s *Server) httpsOrigin(r *http.Request) string {
+	if s.publicURL != nil && s.publicURL.Scheme == "https" {
+		return s.publicURL.String()
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if _, port, err := net.SplitHostPort(s.config.Bind); err == nil && port != "443" {
+		return "https://" + net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host
+}
@@ -0,0 +1,319 @@
+package grombley
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name and its key
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func certName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "one.example")
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.checked = now
+
+	// Renew, making sure the files look modified
+	writeTestCert(t, dir, "two.example")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	cert, _ := c.getCertificate(nil)
+	if name := certName(t, cert); name != "one.example" {
+		t.Errorf("expected the old certificate until the next check, got %s", name)
+	}
+	now = now.Add(certCheckInterval)
+	cert, _ = c.getCertificate(nil)
+	if name := certName(t, cert); name != "two.example" {
+		t.Errorf("expected the renewed certificate, got %s", name)
+	}
+
+	// A half-written renewal keeps the old certificate
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	now = now.Add(certCheckInterval)
+	cert, err = c.getCertificate(nil)
+	if err != nil || certName(t, cert) != "two.example" {
+		t.Errorf("expected a bad renewal to keep the old certificate, got %v", err)
+	}
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("expected a bad key to be refused at startup")
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "example.com")
+
+	testCases := []struct {
+		name   string
+		config TLSConfig
+	}{
+		{"cert without key", TLSConfig{CertFile: certFile}},
+		{"cert and acme", TLSConfig{CertFile: certFile, KeyFile: keyFile, ACME: ACMEConfig{Domains: []string{"example.com"}}}},
+		{"missing cert", TLSConfig{CertFile: certFile + ".missing", KeyFile: keyFile}},
+		{"redirect without tls", TLSConfig{RedirectBind: ":80"}},
+		{"bad domain", TLSConfig{ACME: ACMEConfig{Domains: []string{"https://example.com"}}}},
+		{"bad ca file", TLSConfig{ACME: ACMEConfig{Domains: []string{"example.com"}, CAFile: keyFile}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(Config{UploadPath: t.TempDir(), TLS: tc.config}); err == nil {
+				t.Error("expected the config to be refused")
+			}
+		})
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "example.com")
+
+	testCases := []struct {
+		name   string
+		config Config
+		method string
+		target string
+		code   int
+		want   string
+	}{
+		{"default port", Config{Bind: ":443"}, "GET", "http://example.com/i/a.png?x=1", http.StatusMovedPermanently, "https://example.com/i/a.png?x=1"},
+		{"other port", Config{Bind: "0.0.0.0:8443"}, "GET", "http://example.com:8080/", http.StatusMovedPermanently, "https://example.com:8443/"},
+		{"ipv6", Config{Bind: ":8443"}, "GET", "http://[2001:db8::1]/", http.StatusMovedPermanently, "https://[2001:db8::1]:8443/"},
+		{"keeps method", Config{Bind: ":443"}, "POST", "http://example.com/upload", http.StatusPermanentRedirect, "https://example.com/upload"},
+		{"public url", Config{Bind: ":8443", PublicURL: "https://img.example.com"}, "GET", "http://internal/i/a.png", http.StatusMovedPermanently, "https://img.example.com/i/a.png"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.TLS = TLSConfig{CertFile: certFile, KeyFile: keyFile}
+			s := newTestServerWithConfig(t, tc.config)
+
+			rr := httptest.NewRecorder()
+			s.redirectHandler().ServeHTTP(rr, httptest.NewRequest(tc.method, tc.target, nil))
+			if rr.Code != tc.code {
+				t.Errorf("expected %d, got %d", tc.code, rr.Code)
+			}
+			if got := rr.Header().Get("Location"); got != tc.want {
+				t.Errorf("Location = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestOrderLocations(t *testing.T) {
+	// A CA that, like Pebble, finalizes without saying where the order is
+	ca := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		res := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody}
+		if req.URL.Path == "/new-order" {
+			res.StatusCode = http.StatusCreated
+			res.Header.Set("Location", "https://ca.test/order/1")
+			res.Body = io.NopCloser(strings.NewReader(`{"status":"pending","finalize":"https://ca.test/finalize/1"}`))
+		}
+		return res, nil
+	})
+	client := &http.Client{Transport: newOrderLocations(ca)}
+
+	res, err := client.Post("https://ca.test/new-order", "application/jose+json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if !strings.Contains(string(body), "finalize") {
+		t.Errorf("expected the new order body to be passed on, got %q", body)
+	}
+
+	res, err = client.Post("https://ca.test/finalize/1", "application/jose+json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("Location"); got != "https://ca.test/order/1" {
+		t.Errorf("expected the finalize response to get the order's Location, got %q", got)
+	}
+
+	res, _ = client.Post("https://ca.test/finalize/2", "application/jose+json", nil)
+	if got := res.Header.Get("Location"); got != "" {
+		t.Errorf("expected unknown orders to be left alone, got %q", got)
+	}
+}
+
+func TestACMEChallengeWithPort(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{TLS: TLSConfig{ACME: ACMEConfig{Domains: []string{"grombley.test"}}}})
+
+	// The host policy would refuse grombley.test:5002 with 403
+	rr := httptest.NewRecorder()
+	s.redirectHandler().ServeHTTP(rr, httptest.NewRequest("GET", "http://grombley.test:5002/.well-known/acme-challenge/token", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown token to be 404, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.redirectHandler().ServeHTTP(rr, httptest.NewRequest("GET", "http://grombley.test/i/a.png", nil))
+	if got := rr.Header().Get("Location"); got != "https://grombley.test:3000/i/a.png" {
+		t.Errorf("expected other requests to be redirected, got %q", got)
+	}
+}
+
+// startTLSServer starts s and returns its HTTPS address
+func startTLSServer(t *testing.T, s *Server) string {
+	t.Helper()
+	go s.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		ln := s.listener
+		s.mu.Unlock()
+		if ln != nil {
+			return ln.Addr().String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start listening")
+	return ""
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "example.com")
+	s, err := New(Config{
+		Bind:       "127.0.0.1:0",
+		UploadPath: t.TempDir(),
+		TLS:        TLSConfig{CertFile: certFile, KeyFile: keyFile, RedirectBind: "127.0.0.1:0"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	addr := startTLSServer(t, s)
+
+	pem, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "example.com"},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := client.Get("https://" + addr + "/readyz")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+}
+
+// TestACME gets a certificate from a local ACME server. Run Pebble
+// (https://github.com/letsencrypt/pebble) with PEBBLE_VA_ALWAYS_VALID=1 so
+// it doesn't need to reach us, then set GROMBLEY_TEST_ACME_DIRECTORY to its
+// directory URL and GROMBLEY_TEST_ACME_CA to its test/certs/pebble.minica.pem.
+func TestACME(t *testing.T) {
+	directory := os.Getenv("GROMBLEY_TEST_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("GROMBLEY_TEST_ACME_DIRECTORY not set")
+	}
+
+	uploadPath := t.TempDir()
+	s, err := New(Config{
+		Bind:       "127.0.0.1:0",
+		UploadPath: uploadPath,
+		TLS: TLSConfig{ACME: ACMEConfig{
+			Domains:      []string{"grombley.test"},
+			DirectoryURL: directory,
+			CAFile:       os.Getenv("GROMBLEY_TEST_ACME_CA"),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	addr := startTLSServer(t, s)
+
+	// Pebble issues from a throwaway root, so just look at what we got
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "grombley.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	conn.Close()
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "grombley.test" {
+		t.Errorf("expected a certificate for grombley.test, got %v", leaf.DNSNames)
+	}
+	if _, err := os.Stat(filepath.Join(uploadPath, ".acme", "grombley.test")); err != nil {
+		t.Errorf("expected the certificate to be cached: %v", err)
+	}
+
+	if _, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true}); err == nil {
+		t.Error("expected no certificate for a domain that isn't configured")
+	}
+}
@@ -0,0 +1,509 @@
+package grombley
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation and termination extensions. Chunks are staged under
+// UploadPath/.tus and, once the last byte arrives, the file goes through the
+// same path as a regular upload.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusPath       = "/tus/"
+	tusStagingDir = ".tus"
+
+	// tusMaxAge is how long unfinished (or finished but unfetched) uploads are kept
+	tusMaxAge = 24 * time.Hour
+)
+
+// tusUpload is the bookkeeping for one resumable upload, stored next to its data
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	TTL      time.Duration     `json:"ttl"`
+	Created  time.Time         `json:"created"`
+	// Uploader started the upload; only they may add to it, and it counts
+	// against their quota
+	Uploader string `json:"uploader,omitempty"`
+	// Result is filled in once the upload has been stored as an image
+	Result *uploadResult `json:"result,omitempty"`
+}
+
+// tusStore manages the staging area
+type tusStore struct {
+	dir string
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func newTusStore(uploadPath string) (*tusStore, error) {
+	dir := filepath.Join(uploadPath, tusStagingDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating tus staging directory: %w", err)
+	}
+	return &tusStore{dir: dir, busy: make(map[string]bool)}, nil
+}
+
+func (t *tusStore) dataPath(id string) string {
+	return filepath.Join(t.dir, id)
+}
+
+func (t *tusStore) infoPath(id string) string {
+	return filepath.Join(t.dir, id+".info")
+}
+
+// lock marks an upload as in use, returning false if someone else has it
+func (t *tusStore) lock(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busy[id] {
+		return false
+	}
+	t.busy[id] = true
+	return true
+}
+
+func (t *tusStore) unlock(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.busy, id)
+}
+
+func (t *tusStore) load(id string) (*tusUpload, error) {
+	data, err := os.ReadFile(t.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (t *tusStore) save(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := t.infoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.infoPath(upload.ID))
+}
+
+// offset is how many bytes of the upload have been received
+func (t *tusStore) offset(upload *tusUpload) (int64, error) {
+	if upload.Result != nil {
+		return upload.Length, nil
+	}
+	info, err := os.Stat(t.dataPath(upload.ID))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (t *tusStore) remove(id string) {
+	os.Remove(t.dataPath(id))
+	os.Remove(t.infoPath(id))
+}
+
+// reapStale removes uploads that were started more than tusMaxAge ago
+func (t *tusStore) reapStale(now time.Time) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || !validTusID(id) {
+			continue
+		}
+		upload, err := t.load(id)
+		if err != nil || now.Sub(upload.Created) < tusMaxAge {
+			continue
+		}
+		if t.lock(id) {
+			t.remove(id)
+			t.unlock(id)
+		}
+	}
+}
+
+func newTusID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, where the value may be left out
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q is not valid base64", key)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// setTusResultHeaders tells the client where a finished upload ended up. PATCH
+// responses can't have a body, so this goes in headers.
+func setTusResultHeaders(w http.ResponseWriter, result *uploadResult) {
+	if result == nil {
+		return
+	}
+	w.Header().Set("Image-Url", result.URL)
+	if result.DeleteURL != "" {
+		w.Header().Set("Image-Delete-Url", result.DeleteURL)
+		w.Header().Set("Image-Delete-Token", result.DeleteToken)
+	}
+	if result.Expires != "" {
+		w.Header().Set("Image-Expires", result.Expires)
+	}
+}
+
+// tusOptionsHandler answers discovery, which needs no credentials and so is
+// routed around requireScope
+func (s *Server) tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.config.MaxUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+
+	// An OPTIONS request stays one whatever it asks to be treated as, since
+	// it got here without credentials
+	if r.Method == http.MethodOptions || method == http.MethodOptions {
+		s.tusOptionsHandler(w, r)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, http.StatusPreconditionFailed, errCodeInvalidRequest, "Unsupported tus version")
+		return
+	}
+
+	id := strings.TrimPrefix(path.Clean(r.URL.Path), strings.TrimSuffix(tusPath, "/"))
+	id = strings.TrimPrefix(id, "/")
+
+	if id == "" {
+		if method != http.MethodPost {
+			w.Header().Set("Allow", "OPTIONS, POST")
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s.rateLimit(s.uploadLimiter, s.tusCreate)(w, r)
+		return
+	}
+
+	if !validTusID(id) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Upload not found")
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		s.tusHead(w, r, id)
+	case http.MethodGet:
+		s.tusResult(w, r, id)
+	case http.MethodPatch:
+		// Only requests that create or add to an upload are rate limited, so
+		// a client checking on its progress isn't held back
+		s.rateLimit(s.uploadLimiter, func(w http.ResponseWriter, r *http.Request) {
+			s.tusPatch(w, r, id)
+		})(w, r)
+	case http.MethodDelete:
+		s.tusTerminate(w, r, id)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, GET, PATCH, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// Creation: POST /tus/ with Upload-Length and optional Upload-Metadata
+func (s *Server) tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Missing or invalid Upload-Length")
+		return
+	}
+	if length > s.config.MaxUploadBytes {
+		writeError(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, s.tooLargeMessage())
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	ttl, err := s.requestTTL(r, metadata["expires"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// Refuse an upload that won't fit before any of it is sent
+	uploader, _ := requestUploader(r)
+	if err := s.quotas.check(uploader, length); err != nil {
+		writeUploadError(w, r, &uploadError{http.StatusTooManyRequests, errCodeQuotaExceeded, "Daily upload quota exceeded", err})
+		return
+	}
+
+	id, err := newTusID()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error creating upload")
+		return
+	}
+
+	upload := &tusUpload{
+		ID:       id,
+		Length:   length,
+		Metadata: metadata,
+		TTL:      ttl,
+		Created:  time.Now(),
+		Uploader: uploader,
+	}
+
+	if err := os.WriteFile(s.tus.dataPath(id), nil, 0600); err != nil {
+		fmt.Println("Error creating tus upload:", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error creating upload")
+		return
+	}
+	if err := s.tus.save(upload); err != nil {
+		s.tus.remove(id)
+		fmt.Println("Error creating tus upload:", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error creating upload")
+		return
+	}
+
+	w.Header().Set("Location", s.constructURL(r, tusPath+id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// loadTusUpload loads an upload for the request, which has to come from
+// whoever created it. Anyone else is told it doesn't exist, so an upload URL
+// alone doesn't give away the result or its delete token.
+func (s *Server) loadTusUpload(r *http.Request, id string) (*tusUpload, error) {
+	upload, err := s.tus.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if uploader, _ := requestUploader(r); upload.Uploader != uploader {
+		return nil, fs.ErrNotExist
+	}
+	return upload, nil
+}
+
+// Status: HEAD /tus/<id> reports the current offset
+func (s *Server) tusHead(w http.ResponseWriter, r *http.Request, id string) {
+	upload, err := s.loadTusUpload(r, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	offset, err := s.tus.offset(upload)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	setTusResultHeaders(w, upload.Result)
+	w.WriteHeader(http.StatusOK)
+}
+
+// GET /tus/<id> returns the same response as a regular upload once finished
+func (s *Server) tusResult(w http.ResponseWriter, r *http.Request, id string) {
+	upload, err := s.loadTusUpload(r, id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Upload not found")
+		return
+	}
+	if upload.Result == nil {
+		writeError(w, r, http.StatusConflict, errCodeConflict, "Upload is not complete")
+		return
+	}
+	respondWithFileURL(w, r, *upload.Result)
+}
+
+// Append: PATCH /tus/<id> writes the body at Upload-Offset
+func (s *Server) tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, r, http.StatusUnsupportedMediaType, errCodeInvalidRequest, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	if !s.tus.lock(id) {
+		writeError(w, r, http.StatusConflict, errCodeConflict, "Upload is busy")
+		return
+	}
+	defer s.tus.unlock(id)
+
+	upload, err := s.loadTusUpload(r, id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Upload not found")
+		return
+	}
+	if upload.Result != nil {
+		writeError(w, r, http.StatusConflict, errCodeConflict, "Upload is already complete")
+		return
+	}
+	// Other uploads may have used up the quota since this one was created
+	if err := s.quotas.check(upload.Uploader, upload.Length); err != nil {
+		writeUploadError(w, r, &uploadError{http.StatusTooManyRequests, errCodeQuotaExceeded, "Daily upload quota exceeded", err})
+		return
+	}
+
+	offset, err := s.tus.offset(upload)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Upload not found")
+		return
+	}
+	requested, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Missing or invalid Upload-Offset")
+		return
+	}
+	if requested != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		writeError(w, r, http.StatusConflict, errCodeConflict, "Upload-Offset does not match")
+		return
+	}
+
+	data, err := os.OpenFile(s.tus.dataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Upload not found")
+		return
+	}
+
+	// Keep whatever arrived even if the connection drops part way; that's the
+	// whole point. Anything past the declared length is refused.
+	remaining := upload.Length - offset
+	n, copyErr := io.Copy(data, io.LimitReader(r.Body, remaining+1))
+	if n > remaining {
+		data.Truncate(upload.Length)
+		n = remaining
+		copyErr = errors.New("body exceeds Upload-Length")
+	}
+	data.Close()
+	offset += n
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if copyErr != nil {
+		if s.config.Debug {
+			fmt.Printf("tus upload %s interrupted at %d: %v\n", id, offset, copyErr)
+		}
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Error receiving chunk")
+		return
+	}
+
+	if offset == upload.Length {
+		if !s.tusFinish(w, r, upload) {
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusFinish stores a completed upload as an image, writing an error response
+// and returning false if that fails
+func (s *Server) tusFinish(w http.ResponseWriter, r *http.Request, upload *tusUpload) bool {
+	file, err := os.Open(s.tus.dataPath(upload.ID))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error processing file")
+		return false
+	}
+	result, err := s.storeImage(r, file, uploadOptions{TTL: upload.TTL})
+	file.Close()
+
+	if err != nil {
+		// The data is no use to anyone, so drop the upload
+		s.tus.remove(upload.ID)
+		writeUploadError(w, r, err)
+		return false
+	}
+
+	// Keep the result around so a client that lost the final response can HEAD for it
+	upload.Result = &result
+	if err := s.tus.save(upload); err != nil {
+		fmt.Println("Error saving tus upload result:", err)
+	}
+	os.Remove(s.tus.dataPath(upload.ID))
+
+	setTusResultHeaders(w, &result)
+	return true
+}
+
+// Termination: DELETE /tus/<id> abandons an upload
+func (s *Server) tusTerminate(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.tus.lock(id) {
+		writeError(w, r, http.StatusConflict, errCodeConflict, "Upload is busy")
+		return
+	}
+	defer s.tus.unlock(id)
+
+	if _, err := s.loadTusUpload(r, id); err != nil {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Upload not found")
+		return
+	}
+	s.tus.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
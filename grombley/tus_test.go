@@ -0,0 +1,349 @@
+package grombley
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tusRequest builds a tus request with the protocol header already set
+func tusRequest(method, target string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return req
+}
+
+func serve(s *Server, req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+// tusCreate starts an upload and returns its path
+func tusCreate(t *testing.T, s *Server, length int, metadata string) string {
+	t.Helper()
+	req := tusRequest("POST", "/tus/", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	if metadata != "" {
+		req.Header.Set("Upload-Metadata", metadata)
+	}
+	rr := serve(s, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	location := rr.Header().Get("Location")
+	if !strings.Contains(location, "/tus/") {
+		t.Fatalf("create: unexpected Location %q", location)
+	}
+	return location[strings.Index(location, "/tus/"):]
+}
+
+func tusPatch(s *Server, path string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	req := tusRequest("PATCH", path, chunk)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return serve(s, req)
+}
+
+func TestTusOptions(t *testing.T) {
+	s := newTestServer(t)
+	rr := serve(s, httptest.NewRequest("OPTIONS", "/tus/", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	if v := rr.Header().Get("Tus-Version"); v != tusVersion {
+		t.Errorf("expected Tus-Version %s, got %q", tusVersion, v)
+	}
+	if ext := rr.Header().Get("Tus-Extension"); !strings.Contains(ext, "creation") || !strings.Contains(ext, "termination") {
+		t.Errorf("expected creation and termination extensions, got %q", ext)
+	}
+}
+
+func TestTusRequiresVersion(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("POST", "/tus/", nil)
+	req.Header.Set("Upload-Length", "10")
+	if rr := serve(s, req); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 without Tus-Resumable, got %d", rr.Code)
+	}
+}
+
+func TestTusChunkedUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	data, err := os.ReadFile("../tests/images/test.jpg")
+	if err != nil {
+		t.Fatalf("failed to read test image: %v", err)
+	}
+
+	path := tusCreate(t, s, len(data), "filename "+base64.StdEncoding.EncodeToString([]byte("test.jpg")))
+
+	head := serve(s, tusRequest("HEAD", path, nil))
+	if head.Code != http.StatusOK || head.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("expected offset 0, got %d %q", head.Code, head.Header().Get("Upload-Offset"))
+	}
+
+	half := len(data) / 2
+	rr := tusPatch(s, path, 0, data[:half])
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk: got %d, offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+	if rr.Header().Get("Image-Url") != "" {
+		t.Errorf("upload should not be stored before it is complete")
+	}
+
+	// A client that lost track resumes from the server's offset
+	rr = tusPatch(s, path, 0, data[:10])
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for mismatched offset, got %d", rr.Code)
+	}
+	head = serve(s, tusRequest("HEAD", path, nil))
+	offset, _ := strconv.Atoi(head.Header().Get("Upload-Offset"))
+	if offset != half {
+		t.Fatalf("expected HEAD offset %d, got %d", half, offset)
+	}
+
+	rr = tusPatch(s, path, offset, data[offset:])
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	imageURL := rr.Header().Get("Image-Url")
+	if imageURL == "" || rr.Header().Get("Image-Delete-Token") == "" {
+		t.Fatalf("expected image URL and delete token headers, got %v", rr.Header())
+	}
+	name := imageNameFromURL(imageURL)
+
+	// Stored like any other upload: deduped, type detected, EXIF stripped
+	stored, err := os.ReadFile(filepath.Join(s.config.UploadPath, name))
+	if err != nil {
+		t.Fatalf("stored image missing: %v", err)
+	}
+	expected, _ := stripExifButKeepOrientation(data)
+	if !bytes.Equal(stored, expected) {
+		t.Errorf("stored image differs from a regular upload's processing")
+	}
+	if regular := uploadJSON(t, s, data); regular.URL != imageURL {
+		t.Errorf("expected regular upload of the same file to dedup to %s, got %s", imageURL, regular.URL)
+	}
+
+	// The result stays available if the final response went missing
+	head = serve(s, tusRequest("HEAD", path, nil))
+	if head.Header().Get("Image-Url") != imageURL {
+		t.Errorf("expected HEAD to report %s after completion, got %q", imageURL, head.Header().Get("Image-Url"))
+	}
+	req := tusRequest("GET", path, nil)
+	req.Header.Set("Accept", "application/json")
+	if rr := serve(s, req); !strings.Contains(rr.Body.String(), imageURL) {
+		t.Errorf("expected GET to return the upload result, got %s", rr.Body.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(s.tus.dir, strings.TrimPrefix(path, "/tus/"))); !os.IsNotExist(err) {
+		t.Errorf("expected staged data to be cleaned up")
+	}
+}
+
+func TestTusRejectsOverlongChunk(t *testing.T) {
+	s := newTestServer(t)
+	path := tusCreate(t, s, 4, "")
+
+	rr := tusPatch(s, path, 0, []byte("too long"))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for chunk past Upload-Length, got %d", rr.Code)
+	}
+	if rr.Header().Get("Upload-Offset") != "4" {
+		t.Errorf("expected the declared 4 bytes to be kept, got offset %q", rr.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestTusUnsupportedType(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("definitely not an image")
+	path := tusCreate(t, s, len(data), "")
+
+	rr := tusPatch(s, path, 0, data)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unsupported type, got %d", rr.Code)
+	}
+	if rr := serve(s, tusRequest("HEAD", path, nil)); rr.Code != http.StatusNotFound {
+		t.Errorf("expected failed upload to be dropped, got %d", rr.Code)
+	}
+}
+
+func TestTusTermination(t *testing.T) {
+	s := newTestServer(t)
+	path := tusCreate(t, s, 100, "")
+	tusPatch(s, path, 0, []byte("some bytes"))
+
+	if rr := serve(s, tusRequest("DELETE", path, nil)); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 on termination, got %d", rr.Code)
+	}
+	if rr := serve(s, tusRequest("HEAD", path, nil)); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after termination, got %d", rr.Code)
+	}
+	if rr := tusPatch(s, path, 10, []byte("more")); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 patching a terminated upload, got %d", rr.Code)
+	}
+}
+
+func TestTusExpiryMetadata(t *testing.T) {
+	s := newTestServer(t)
+	data := testPNG(t, 80)
+	path := tusCreate(t, s, len(data), "expires "+base64.StdEncoding.EncodeToString([]byte("1h")))
+
+	rr := tusPatch(s, path, 0, data)
+	if rr.Header().Get("Image-Expires") == "" {
+		t.Errorf("expected expiry from metadata to apply, got headers %v", rr.Header())
+	}
+}
+
+func TestTusRateLimited(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{UploadRate: RateLimitConfig{Rate: 0.01, Burst: 2}})
+	data := testPNG(t, 81)
+
+	path := tusCreate(t, s, len(data), "")
+	if rr := tusPatch(s, path, 0, data[:10]); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the first chunk to be accepted, got %d", rr.Code)
+	}
+	if rr := tusPatch(s, path, 10, data[10:]); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a chunk over the upload rate to be refused, got %d", rr.Code)
+	}
+	req := tusRequest("POST", "/tus/", nil)
+	req.Header.Set("Upload-Length", "10")
+	if rr := serve(s, req); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected creation over the upload rate to be refused, got %d", rr.Code)
+	}
+	if rr := serve(s, tusRequest("HEAD", path, nil)); rr.Code != http.StatusOK {
+		t.Errorf("expected HEAD not to be rate limited, got %d", rr.Code)
+	}
+}
+
+func TestTusQuota(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		APITokens: []APIToken{
+			{Name: "small", Hash: hashToken("small-secret"), Scopes: []string{scopeUpload}, DailyUploads: 1, DailyBytes: 1 << 20},
+			{Name: "other", Hash: hashToken("other-secret"), Scopes: []string{scopeUpload}},
+		},
+	})
+	withToken := func(req *http.Request, token string) *http.Request {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	create := func(length int) *httptest.ResponseRecorder {
+		req := tusRequest("POST", "/tus/", nil)
+		req.Header.Set("Upload-Length", strconv.Itoa(length))
+		return serve(s, withToken(req, "small-secret"))
+	}
+	patch := func(path string, offset int, chunk []byte, token string) *httptest.ResponseRecorder {
+		req := tusRequest("PATCH", path, chunk)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		return serve(s, withToken(req, token))
+	}
+
+	if rr := create(2 << 20); rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected an upload over the byte quota to be refused up front, got %d", rr.Code)
+	}
+
+	// Two uploads started while the quota has room for one
+	first, second := testPNG(t, 82), testPNG(t, 83)
+	rr := create(len(first))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	firstPath := rr.Header().Get("Location")
+	firstPath = firstPath[strings.Index(firstPath, "/tus/"):]
+	rr = create(len(second))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	secondPath := rr.Header().Get("Location")
+	secondPath = secondPath[strings.Index(secondPath, "/tus/"):]
+
+	if rr := patch(firstPath, 0, first, "other-secret"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected another uploader's upload to be off limits, got %d", rr.Code)
+	}
+	if rr := patch(firstPath, 0, first, "small-secret"); rr.Code != http.StatusNoContent || rr.Header().Get("Image-Url") == "" {
+		t.Fatalf("expected the first upload to be stored, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := patch(secondPath, 0, second, "small-secret"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected data over the quota to be refused, got %d", rr.Code)
+	}
+	if rr := create(len(second)); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected creation over the quota to be refused, got %d", rr.Code)
+	}
+	if s.images.Count() != 1 {
+		t.Errorf("expected only the first upload to be stored, got %d", s.images.Count())
+	}
+}
+
+func TestTusUploadsBelongToTheirUploader(t *testing.T) {
+	s := newTestServerWithConfig(t, Config{
+		APITokens: []APIToken{
+			{Name: "owner", Hash: hashToken("owner-secret"), Scopes: []string{scopeUpload}},
+			{Name: "other", Hash: hashToken("other-secret"), Scopes: []string{scopeUpload}},
+		},
+	})
+	as := func(req *http.Request, token string) *httptest.ResponseRecorder {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serve(s, req)
+	}
+	create := func(length int) string {
+		req := tusRequest("POST", "/tus/", nil)
+		req.Header.Set("Upload-Length", strconv.Itoa(length))
+		rr := as(req, "owner-secret")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("create: expected 201, got %d: %s", rr.Code, rr.Body.String())
+		}
+		location := rr.Header().Get("Location")
+		return location[strings.Index(location, "/tus/"):]
+	}
+
+	data := testPNG(t, 84)
+	finished := create(len(data))
+	req := tusRequest("PATCH", finished, data)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	if rr := as(req, "owner-secret"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the upload to finish, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for _, method := range []string{"HEAD", "GET", "DELETE"} {
+		rr := as(tusRequest(method, finished, nil), "other-secret")
+		if rr.Code != http.StatusNotFound || rr.Header().Get("Image-Delete-Token") != "" || strings.Contains(rr.Body.String(), "delete") {
+			t.Errorf("%s: expected another uploader to get a 404, got %d with %v", method, rr.Code, rr.Header())
+		}
+	}
+	if rr := as(tusRequest("HEAD", finished, nil), "owner-secret"); rr.Code != http.StatusOK || rr.Header().Get("Image-Delete-Token") == "" {
+		t.Errorf("expected the owner to see the result, got %d", rr.Code)
+	}
+
+	pending := create(100)
+	if rr := as(tusRequest("DELETE", pending, nil), "other-secret"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected another uploader not to terminate the upload, got %d", rr.Code)
+	}
+	if rr := as(tusRequest("HEAD", pending, nil), "owner-secret"); rr.Code != http.StatusOK {
+		t.Errorf("expected the upload to survive, got %d", rr.Code)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["filename"] != "world_domination_plan.pdf" {
+		t.Errorf("unexpected filename %q", metadata["filename"])
+	}
+	if _, ok := metadata["is_confidential"]; !ok {
+		t.Errorf("expected key without value to be present")
+	}
+	if _, err := parseTusMetadata("filename !!!"); err == nil {
+		t.Errorf("expected invalid base64 to be rejected")
+	}
+}
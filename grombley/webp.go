@@ -0,0 +1,143 @@
+package grombley
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	exif "github.com/dsoprea/go-exif/v3"
+)
+
+// WebP files are a RIFF container of chunks. Metadata lives in EXIF and
+// "XMP " chunks, announced by flags in the VP8X header chunk.
+
+// VP8X flags for the metadata chunks
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// exifHeader is the prefix some writers put before the TIFF data in a WebP
+// EXIF chunk, as JPEG's APP1 segment has
+var exifHeader = []byte("Exif\x00\x00")
+
+// webpChunk is one chunk of a WebP file
+type webpChunk struct {
+	FourCC string
+	Data   []byte
+}
+
+// isWebP checks if the data is a WebP image
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// parseWebP splits WebP data into its chunks
+func parseWebP(data []byte) ([]webpChunk, error) {
+	if !isWebP(data) {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+	// Ignore anything past the RIFF size, as decoders do
+	if size := int(binary.LittleEndian.Uint32(data[4:8])) + 8; size >= 12 && size < len(data) {
+		data = data[:size]
+	}
+
+	var chunks []webpChunk
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("truncated WebP chunk header")
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if size < 0 || size > len(data)-pos {
+			return nil, fmt.Errorf("truncated WebP %q chunk", fourCC)
+		}
+		chunks = append(chunks, webpChunk{FourCC: fourCC, Data: data[pos : pos+size]})
+		// Chunks are padded to an even length
+		pos += size + size%2
+	}
+	return chunks, nil
+}
+
+// writeWebP reassembles chunks into a WebP file
+func writeWebP(chunks []webpChunk) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		body.WriteString(chunk.FourCC)
+		binary.Write(&body, binary.LittleEndian, uint32(len(chunk.Data)))
+		body.Write(chunk.Data)
+		if len(chunk.Data)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// webpExif returns the TIFF data from a WebP's EXIF chunk
+func webpExif(chunks []webpChunk) ([]byte, bool) {
+	for _, chunk := range chunks {
+		if chunk.FourCC == "EXIF" {
+			return bytes.TrimPrefix(chunk.Data, exifHeader), true
+		}
+	}
+	return nil, false
+}
+
+// stripExifFromWebP drops EXIF and XMP chunks, keeping a minimal EXIF chunk
+// with just the orientation if the image had one
+func stripExifFromWebP(data []byte, keepOrientation bool) ([]byte, error) {
+	chunks, err := parseWebP(data)
+	if err != nil {
+		return data, nil
+	}
+
+	orientation := uint16(1)
+	if exifData, ok := webpExif(chunks); ok {
+		orientation = extractOrientation(exifData)
+	}
+
+	var exifChunk []byte
+	if keepOrientation && orientation != 1 {
+		rootIb, err := buildOrientationExif(orientation)
+		if err == nil {
+			exifChunk, err = exif.NewIfdByteEncoder().EncodeToExif(rootIb)
+		}
+		if err != nil {
+			// Carry on without it, as for the other formats
+			exifChunk = nil
+		}
+	}
+
+	filtered := make([]webpChunk, 0, len(chunks)+1)
+	for _, chunk := range chunks {
+		switch chunk.FourCC {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if len(chunk.Data) > 0 {
+				// Copy so the caller's data isn't modified
+				header := append([]byte(nil), chunk.Data...)
+				header[0] &^= webpFlagEXIF | webpFlagXMP
+				if exifChunk != nil {
+					header[0] |= webpFlagEXIF
+				}
+				chunk.Data = header
+			}
+		}
+		filtered = append(filtered, chunk)
+	}
+
+	// EXIF goes at the end, after the image data
+	if exifChunk != nil {
+		filtered = append(filtered, webpChunk{FourCC: "EXIF", Data: exifChunk})
+	}
+	return writeWebP(filtered), nil
+}
@@ -0,0 +1,193 @@
+package grombley
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	exif "github.com/dsoprea/go-exif/v3"
+)
+
+// solidWebP returns a lossless WebP of a single color. With one symbol per
+// prefix code every pixel takes zero bits, so it's easy to write by hand.
+func solidWebP(t *testing.T, width, height int, c color.NRGBA) []byte {
+	t.Helper()
+	var bits uint64
+	var n uint
+	var out []byte
+	put := func(v uint64, count uint) {
+		bits |= v << n
+		n += count
+		for n >= 8 {
+			out = append(out, byte(bits))
+			bits >>= 8
+			n -= 8
+		}
+	}
+
+	out = append(out, 0x2f)
+	put(uint64(width-1), 14)
+	put(uint64(height-1), 14)
+	put(1, 1) // alpha is used
+	put(0, 3) // version
+	put(0, 1) // no transforms
+	put(0, 1) // no color cache
+	put(0, 1) // no meta prefix codes
+	// Green, red, blue, alpha and distance codes, each a single 8-bit symbol
+	for _, symbol := range []uint8{c.G, c.R, c.B, c.A, 0} {
+		put(1, 1) // simple code
+		put(0, 1) // one symbol
+		put(1, 1) // eight bits wide
+		put(uint64(symbol), 8)
+	}
+	if n > 0 {
+		out = append(out, byte(bits))
+	}
+
+	return writeWebP([]webpChunk{{FourCC: "VP8L", Data: out}})
+}
+
+// extendedWebP wraps an image in the extended format with an EXIF chunk
+// holding orientation and an XMP chunk
+func extendedWebP(t *testing.T, data []byte, orientation uint16) []byte {
+	t.Helper()
+	chunks, err := parseWebP(data)
+	if err != nil {
+		t.Fatalf("failed to parse WebP: %v", err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read WebP size: %v", err)
+	}
+
+	rootIb, err := buildOrientationExif(orientation)
+	if err != nil {
+		t.Fatalf("failed to build EXIF: %v", err)
+	}
+	if err := rootIb.AddStandardWithName("Artist", "Somebody Private"); err != nil {
+		t.Fatalf("failed to add EXIF tag: %v", err)
+	}
+	exifData, err := exif.NewIfdByteEncoder().EncodeToExif(rootIb)
+	if err != nil {
+		t.Fatalf("failed to encode EXIF: %v", err)
+	}
+
+	header := make([]byte, 10)
+	header[0] = webpFlagEXIF | webpFlagXMP
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(cfg.Width-1))
+	copy(header[4:7], size[:3])
+	binary.LittleEndian.PutUint32(size[:], uint32(cfg.Height-1))
+	copy(header[7:10], size[:3])
+
+	extended := []webpChunk{{FourCC: "VP8X", Data: header}}
+	extended = append(extended, chunks...)
+	extended = append(extended,
+		webpChunk{FourCC: "EXIF", Data: append(append([]byte(nil), exifHeader...), exifData...)},
+		webpChunk{FourCC: "XMP ", Data: []byte(`<x:xmpmeta>secret location</x:xmpmeta>`)},
+	)
+	return writeWebP(extended)
+}
+
+func TestStripExifFromWebP(t *testing.T) {
+	data := extendedWebP(t, solidWebP(t, 20, 10, color.NRGBA{255, 0, 0, 255}), 6)
+	if o := getImageOrientation(data); o != 6 {
+		t.Fatalf("test image has orientation %d, want 6", o)
+	}
+
+	stripped, err := stripExifButKeepOrientation(data)
+	if err != nil {
+		t.Fatalf("stripExifButKeepOrientation failed: %v", err)
+	}
+	if bytes.Contains(stripped, []byte("secret")) || bytes.Contains(stripped, []byte("Somebody")) {
+		t.Error("expected XMP and EXIF metadata to be removed")
+	}
+	if o := getImageOrientation(stripped); o != 6 {
+		t.Errorf("expected orientation 6 to be kept, got %d", o)
+	}
+	chunks, err := parseWebP(stripped)
+	if err != nil {
+		t.Fatalf("stripped WebP doesn't parse: %v", err)
+	}
+	if flags := chunks[0].Data[0]; flags&webpFlagXMP != 0 || flags&webpFlagEXIF == 0 {
+		t.Errorf("VP8X flags %#x don't match the remaining chunks", flags)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped WebP doesn't decode: %v", err)
+	}
+
+	stripped, err = stripExif(data)
+	if err != nil {
+		t.Fatalf("stripExif failed: %v", err)
+	}
+	chunks, err = parseWebP(stripped)
+	if err != nil {
+		t.Fatalf("stripped WebP doesn't parse: %v", err)
+	}
+	if _, ok := webpExif(chunks); ok {
+		t.Error("expected stripExif to remove the EXIF chunk")
+	}
+	if flags := chunks[0].Data[0]; flags&(webpFlagXMP|webpFlagEXIF) != 0 {
+		t.Errorf("VP8X flags %#x still announce metadata", flags)
+	}
+}
+
+func TestWebPUpload(t *testing.T) {
+	s := newTestServer(t)
+	data := extendedWebP(t, solidWebP(t, 200, 100, color.NRGBA{0, 0, 255, 255}), 6)
+
+	result := uploadJSON(t, s, data)
+	name := imageNameFromURL(result.URL)
+	if !strings.HasSuffix(name, ".webp") {
+		t.Fatalf("expected a .webp name, got %s", name)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(s.config.UploadPath, name))
+	if err != nil {
+		t.Fatalf("stored image missing: %v", err)
+	}
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Error("expected XMP to be stripped on upload")
+	}
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/i/"+name, nil))
+	if ct := rr.Header().Get("Content-Type"); rr.Code != http.StatusOK || ct != "image/webp" {
+		t.Errorf("expected image/webp, got %d %s", rr.Code, ct)
+	}
+
+	// Opaque WebP thumbnails are JPEG, turned upright
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("thumbnail failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("expected Content-Type image/jpeg, got %s", ct)
+	}
+	img, _, err := image.Decode(rr.Body)
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 25 || b.Dy() != 50 {
+		t.Errorf("thumbnail is %dx%d, want 25x50", b.Dx(), b.Dy())
+	}
+}
+
+func TestTransparentWebPThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	name := imageNameFromURL(uploadJSON(t, s, solidWebP(t, 40, 40, color.NRGBA{0, 255, 0, 100})).URL)
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/t/"+name, nil))
+	if ct := rr.Header().Get("Content-Type"); rr.Code != http.StatusOK || ct != "image/png" {
+		t.Errorf("expected a PNG thumbnail, got %d %s", rr.Code, ct)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // Helper function to calculate expected absolute path from a relative path
@@ -77,6 +78,287 @@ upload_path = "./grapes/"
 		}
 	})
 
+	t.Run("load expiry settings from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-ttl-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+default_ttl = "72h"
+max_ttl = "720h"
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.DefaultTTL != 72*time.Hour {
+			t.Errorf("Expected default_ttl to be 72h, but got %s", config.DefaultTTL)
+		}
+
+		if config.MaxTTL != 720*time.Hour {
+			t.Errorf("Expected max_ttl to be 720h, but got %s", config.MaxTTL)
+		}
+	})
+
+	t.Run("load upload limits from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-limits-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+max_upload_bytes = 1048576
+max_pixels = 4000000
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.MaxUploadBytes != 1048576 {
+			t.Errorf("Expected max_upload_bytes to be 1048576, but got %d", config.MaxUploadBytes)
+		}
+
+		if config.MaxPixels != 4000000 {
+			t.Errorf("Expected max_pixels to be 4000000, but got %d", config.MaxPixels)
+		}
+	})
+
+	t.Run("load thumbnail cache settings from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-thumbs-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+thumb_cache_path = "/var/cache/grombley"
+thumb_cache_bytes = 1048576
+thumb_sizes = ["100x100", "800x600"]
+normalize_orientation = true
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.ThumbCachePath != "/var/cache/grombley" {
+			t.Errorf("Expected thumb_cache_path to be /var/cache/grombley, but got %s", config.ThumbCachePath)
+		}
+
+		if config.ThumbCacheBytes != 1048576 {
+			t.Errorf("Expected thumb_cache_bytes to be 1048576, but got %d", config.ThumbCacheBytes)
+		}
+
+		if len(config.ThumbSizes) != 2 || config.ThumbSizes[1] != "800x600" {
+			t.Errorf("Expected thumb_sizes to be [100x100 800x600], but got %v", config.ThumbSizes)
+		}
+
+		if !config.NormalizeOrientation {
+			t.Errorf("Expected normalize_orientation to be true, but got false")
+		}
+	})
+
+	t.Run("load api tokens from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-tokens-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+token_file = "/etc/grombley/tokens.toml"
+
+[[api_tokens]]
+name = "ci"
+hash = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+scopes = ["upload", "delete"]
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.TokenFile != "/etc/grombley/tokens.toml" {
+			t.Errorf("Expected token_file to be /etc/grombley/tokens.toml, but got %s", config.TokenFile)
+		}
+
+		if len(config.APITokens) != 1 || config.APITokens[0].Name != "ci" || len(config.APITokens[0].Scopes) != 2 {
+			t.Errorf("Expected one api token named ci with two scopes, but got %+v", config.APITokens)
+		}
+	})
+
+	t.Run("load oidc settings from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-oidc-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+[oidc]
+issuer = "https://sso.example.com"
+client_id = "grombley"
+allowed_domains = ["example.com"]
+session_ttl = "8h"
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.OIDC.Issuer != "https://sso.example.com" || config.OIDC.ClientID != "grombley" {
+			t.Errorf("Expected the oidc issuer and client to be loaded, but got %+v", config.OIDC)
+		}
+
+		if len(config.OIDC.AllowedDomains) != 1 || config.OIDC.AllowedDomains[0] != "example.com" {
+			t.Errorf("Expected allowed_domains to be [example.com], but got %v", config.OIDC.AllowedDomains)
+		}
+
+		if config.OIDC.SessionTTL != 8*time.Hour {
+			t.Errorf("Expected session_ttl to be 8h, but got %s", config.OIDC.SessionTTL)
+		}
+	})
+
+	t.Run("load fetch_max_redirects of 0 from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-fetch-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		if _, err := tempFile.Write([]byte("fetch_max_redirects = 0\n")); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.FetchMaxRedirects == nil || *config.FetchMaxRedirects != 0 {
+			t.Errorf("Expected fetch_max_redirects to be 0, but got %v", config.FetchMaxRedirects)
+		}
+	})
+
+	t.Run("load tls settings from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-tls-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+[tls]
+redirect_bind = "0.0.0.0:80"
+
+[tls.acme]
+domains = ["img.example.com"]
+email = "admin@example.com"
+directory_url = "https://localhost:14000/dir"
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.TLS.RedirectBind != "0.0.0.0:80" {
+			t.Errorf("Expected redirect_bind to be 0.0.0.0:80, but got %s", config.TLS.RedirectBind)
+		}
+
+		if len(config.TLS.ACME.Domains) != 1 || config.TLS.ACME.Domains[0] != "img.example.com" {
+			t.Errorf("Expected acme domains to be [img.example.com], but got %v", config.TLS.ACME.Domains)
+		}
+
+		if config.TLS.ACME.Email != "admin@example.com" || config.TLS.ACME.DirectoryURL != "https://localhost:14000/dir" {
+			t.Errorf("Expected the acme email and directory to be loaded, but got %+v", config.TLS.ACME)
+		}
+	})
+
+	t.Run("load rate limits and quotas from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-limits-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+daily_uploads = 100
+daily_bytes = 104857600
+trusted_proxies = ["10.0.0.0/8"]
+public_url = "https://img.example.com"
+
+[upload_rate]
+rate = 0.5
+burst = 5
+
+[thumb_rate]
+rate = 20
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.UploadRate.Rate != 0.5 || config.UploadRate.Burst != 5 {
+			t.Errorf("Expected upload_rate to be 0.5/s bursting to 5, but got %+v", config.UploadRate)
+		}
+
+		if config.ThumbRate.Rate != 20 {
+			t.Errorf("Expected thumb_rate to be 20/s, but got %+v", config.ThumbRate)
+		}
+
+		if config.DailyUploads != 100 || config.DailyBytes != 104857600 {
+			t.Errorf("Expected daily quotas of 100 uploads and 104857600 bytes, but got %d and %d", config.DailyUploads, config.DailyBytes)
+		}
+
+		if len(config.TrustedProxies) != 1 || config.TrustedProxies[0] != "10.0.0.0/8" {
+			t.Errorf("Expected trusted_proxies to be [10.0.0.0/8], but got %v", config.TrustedProxies)
+		}
+
+		if config.PublicURL != "https://img.example.com" {
+			t.Errorf("Expected public_url to be https://img.example.com, but got %s", config.PublicURL)
+		}
+	})
+
+	t.Run("load s3 storage from file", func(t *testing.T) {
+		tempFile, err := os.CreateTemp("", "config-s3-*.toml")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		configContent := `
+storage = "s3"
+
+[s3]
+endpoint = "http://minio:9000"
+bucket = "grombley"
+path_style = true
+`
+		if _, err := tempFile.Write([]byte(configContent)); err != nil {
+			t.Fatalf("Error writing to temporary file: %v", err)
+		}
+
+		config := loadConfig(tempFile.Name())
+
+		if config.Storage != "s3" {
+			t.Errorf("Expected storage to be s3, but got %s", config.Storage)
+		}
+
+		if config.S3.Endpoint != "http://minio:9000" || config.S3.Bucket != "grombley" || !config.S3.PathStyle {
+			t.Errorf("Expected s3 settings to be loaded, but got %+v", config.S3)
+		}
+	})
+
 	t.Run("load partial config with defaults", func(t *testing.T) {
 		tempFile, err := os.CreateTemp("", "config-partial-*.toml")
 		if err != nil {
@@ -1,98 +1,64 @@
 package main
 
 import (
-	"embed"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"path"
-)
-
-type Config struct {
-	Bind       string `toml:"bind"`
-	Debug      bool   `toml:"debug"`
-	ServePath  string `toml:"serve_path"`
-	UploadPath string `toml:"upload_path"`
-}
+	"os/signal"
+	"syscall"
+	"time"
 
-var config Config
-var hashes map[string]string
-var mimeTypeHandler MimeTypeHandler
-
-//go:embed templates
-var templatesFolder embed.FS
+	"github.com/rbuysse/image-uploader/grombley"
+)
 
 func main() {
 
-	config = GenerateConfig()
-	mimeTypeHandler = *newMimeTypeHandler()
+	config := GenerateConfig()
 
-	// Create the upload directory if it doesn't exist
-	if _, err := os.Stat(config.UploadPath); os.IsNotExist(err) {
-		fmt.Printf("Creating upload directory at %s\n", config.UploadPath)
-		os.MkdirAll(config.UploadPath, os.ModePerm)
+	server, err := grombley.New(config)
+	if err != nil {
+		log.Fatal(err)
 	}
-	var err error
-
-	hashesChan := make(chan map[string]string)
-	errChan := make(chan error)
-
-	hashes, err = buildHashDict(config.UploadPath)
-	go func() {
-		hashes, err := buildHashDict(config.UploadPath)
-		if err != nil {
-			errChan <- err
-			return
-		}
-		hashesChan <- hashes
-	}()
-
-	// Create a new HTTP router
-	http.HandleFunc("/livez", livezHandler)
-	http.HandleFunc("/readyz", readyzHandler)
-	http.HandleFunc("/t/", serveThumbnailImageHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/url", urlUploadHandler)
-	http.HandleFunc(config.ServePath, serveImageHandler)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		filePath := path.Join("templates", r.URL.Path)
-		if r.URL.Path == "/" {
-			filePath = "templates/index.html"
-		}
-		file, err := templatesFolder.Open(filePath)
-		if err != nil {
-			notfoundHandler(w)
-			return
-		}
-		defer file.Close()
-
-		io.Copy(w, file)
-	})
 
 	if config.Debug {
 		fmt.Println("Debug mode is enabled")
 	}
 
-	fmt.Printf("Server is running on http://%s\n"+
+	scheme := "http"
+	if config.TLS.CertFile != "" || len(config.TLS.ACME.Domains) > 0 {
+		scheme = "https"
+	}
+
+	fmt.Printf("Server is running on %s://%s\n"+
 		"Serving images at %s\n"+
 		"Upload path is %s\n",
 
-		config.Bind, config.ServePath, config.UploadPath)
+		scheme, config.Bind, config.ServePath, config.UploadPath)
 
-	select {
-	case hashes = <-hashesChan:
-	case err = <-errChan:
-		fmt.Printf("Error: %v\n", err)
-		return
+	if scheme == "https" && config.TLS.RedirectBind != "" {
+		fmt.Printf("Redirecting HTTP on %s to HTTPS\n", config.TLS.RedirectBind)
 	}
 
-	if config.Debug {
-		for hash, filename := range hashes {
-			fmt.Printf("MD5 Hash: %s, Filename: %s\n", hash, filename)
+	// Shut down cleanly so the hash index is closed properly. Start returns
+	// as soon as Shutdown begins, so wait for it to finish before exiting.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Printf("Error shutting down: %v\n", err)
 		}
-	}
+	}()
 
-	log.Fatal(http.ListenAndServe(config.Bind, nil))
+	if err := server.Start(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
@@ -67,6 +67,22 @@ else
   ERRORS=$((ERRORS+1))
 fi
 
+# --== Raw Upload Test ==--
+
+printf "Testing raw upload: "
+
+IMAGELOC="$(curl -s -T /tmp/test.jpg grombley:3000/upload/raw-test.jpg)"
+
+curl --fail-with-body -s -I "$IMAGELOC" | tee > /tmp/raw
+
+if grep -q "$CONTENT_TYPE" /tmp/raw; then
+  printf "✅ - Raw upload success\n\n"
+else
+  printf "❌ - Raw upload failed\n\n"
+  cat /tmp/raw
+  ERRORS=$((ERRORS+1))
+fi
+
 # --== Duplicate Upload Test ==--
 
 printf "Testing duplicate upload: "